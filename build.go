@@ -0,0 +1,111 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iptrie
+
+import (
+	"bytes"
+	"errors"
+	"net"
+)
+
+// A Range is a range of IP addresses and the data associated with it.
+type Range struct {
+	Start net.IP
+	End   net.IP
+	Data  interface{}
+}
+
+// ErrUnsorted is returned by BuildIPTrie when the ranges are not sorted by
+// their start address.
+var ErrUnsorted = errors.New("iptrie: ranges are not sorted")
+
+// BuildIPTrie creates an IPTrie from ranges sorted by start address.  Since
+// the new IPTrie is not shared until it is returned the nodes are created
+// without taking any locks, and consecutive addresses reuse the path walked
+// for the previous one.  This is much faster than calling AddRangeIp for every
+// range when loading a large data set.
+func BuildIPTrie(rs []Range) (*IPTrie, error) {
+	var last net.IP
+	for i := range rs {
+		s := rs[i].Start.To16()
+		if last != nil && bytes.Compare(last, s) > 0 {
+			return nil, ErrUnsorted
+		}
+		last = s
+	}
+	t := NewIPTrie()
+	b := &builder{root: t}
+	for i := range rs {
+		b.addRange(rs[i])
+	}
+	return t, nil
+}
+
+// AddRanges places a batch of ranges into the IPTrie and saves the associated
+// data for later retrieval.  The ranges may be in any order but a batch sorted
+// by start address is added faster, since consecutive addresses reuse the path
+// walked for the previous one.
+func (t *IPTrie) AddRanges(rs []Range) {
+	b := &builder{root: t, lock: true}
+	for i := range rs {
+		b.addRange(rs[i])
+	}
+}
+
+// A builder adds addresses to an IPTrie remembering the nodes on the path to
+// the last address added.
+type builder struct {
+	root *IPTrie
+	lock bool
+	last []byte
+	path []*IPTrie
+}
+
+func (b *builder) addRange(r Range) {
+	lts := b.add(r.Start.To16())
+	lts.rangeStart = lts
+	lts.data = r.Data
+	lte := b.add(r.End.To16())
+	lte.rangeStart = lts
+}
+
+// add is like IPTrie.add but starts from the deepest node shared with the
+// previous address.
+func (b *builder) add(a []byte) *IPTrie {
+	e := len(a) - 1
+	for ; e > 0; e-- {
+		if a[e] != 0 {
+			break
+		}
+	}
+	n := 0
+	for n <= e && n < len(b.last) && a[n] == b.last[n] {
+		n++
+	}
+	p := b.root
+	if n > 0 {
+		p = b.path[n-1]
+	}
+	b.path = b.path[:n]
+	var k *IPTrie
+	for i := n; i <= e; i++ {
+		if b.lock {
+			p.m.Lock()
+		}
+		k = p.kids[a[i]]
+		if k == nil {
+			k = newIPTrie(p)
+			k.b = a[i]
+			p.kids[a[i]] = k
+		}
+		if b.lock {
+			p.m.Unlock()
+		}
+		b.path = append(b.path, k)
+		p = k
+	}
+	b.last = append(b.last[:0], a[:e+1]...)
+	return p
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iptrie
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"testing"
+)
+
+func rndRanges(size int) []Range {
+	rs := make([]Range, size)
+	for i := range rs {
+		ip := rndIPv4()
+		ip[15] = byte(1)
+		s := make(net.IP, len(ip))
+		copy(s, ip)
+		ip[15] = byte(254)
+		rs[i] = Range{s, ip, &testData{i}}
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		return bytes.Compare(rs[i].Start, rs[j].Start) < 0
+	})
+	return rs
+}
+
+func TestBuildIPTrie(t *testing.T) {
+	rs := rndRanges(1000)
+	tt, err := BuildIPTrie(rs)
+	if err != nil {
+		t.Fatalf("BuildIPTrie: %v", err)
+	}
+	ta := NewIPTrie()
+	ta.AddRanges(rs)
+	for _, r := range rs {
+		if !hasRange(tt, r.Start, r.End) {
+			t.Errorf("BuildIPTrie: missing %v-%v", r.Start, r.End)
+		}
+		if !hasRange(ta, r.Start, r.End) {
+			t.Errorf("AddRanges: missing %v-%v", r.Start, r.End)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		s := rndIPv4().String()
+		if tt.Get(s) != ta.Get(s) {
+			t.Errorf("Get(%s): BuildIPTrie and AddRanges differ", s)
+		}
+	}
+
+	rs[0], rs[1] = rs[1], rs[0]
+	if _, err = BuildIPTrie(rs); err != ErrUnsorted {
+		t.Errorf("BuildIPTrie = %v, want ErrUnsorted", err)
+	}
+}
+
+func BenchmarkBuildIPTrie(b *testing.B) {
+	rs := rndRanges(b.N)
+	b.ResetTimer()
+	BuildIPTrie(rs)
+}
+
+func BenchmarkAddRanges(b *testing.B) {
+	rs := rndRanges(b.N)
+	tt := NewIPTrie()
+	b.ResetTimer()
+	tt.AddRanges(rs)
+}
@@ -0,0 +1,65 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Geoipd serves IP geolocation lookups over HTTP as JSON.  It loads the
+// maxmind files from a directory at startup, see geo.OpenDB, and answers the
+// following requests:
+//
+//	GET  /lookup/{ip}  location and AS of one address
+//	POST /lookup       a JSON array of addresses, answered with an array
+//	GET  /healthz      200 while the process is running
+//	GET  /readyz       200 once the data is loaded
+//
+// When -admin is set, a second listener on that address answers:
+//
+//	POST /reload       reload the data from the directory
+//
+// Sending SIGHUP also reloads the data.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"code.google.com/p/iptrie/geo"
+)
+
+var (
+	addr  = flag.String("addr", ":8080", "address to listen on")
+	dir   = flag.String("dir", ".", "directory holding the maxmind files")
+	admin = flag.String("admin", "", "private address for /reload, disabled if empty")
+)
+
+func main() {
+	flag.Parse()
+	s := newServer(func() (*geo.DB, error) {
+		return geo.OpenDB(*dir)
+	})
+	go func() {
+		if err := s.reload(); err != nil {
+			log.Printf("geoipd: loading %s: %v", *dir, err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := s.reload(); err != nil {
+				log.Printf("geoipd: reloading %s: %v", *dir, err)
+			}
+		}
+	}()
+
+	if *admin != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*admin, s.admin))
+		}()
+	}
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
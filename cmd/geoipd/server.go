@@ -0,0 +1,160 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"code.google.com/p/iptrie/geo"
+)
+
+const (
+	maxBatch     = 1000    // largest number of addresses in a batch lookup
+	maxBatchBody = 1 << 20 // largest batch lookup body in bytes
+)
+
+// A server answers lookups from the last geo.DB that was loaded.  Reloads
+// are only served by the admin handler, which is meant for a separate,
+// private address.
+type server struct {
+	db    *geo.DBReloader
+	mux   *http.ServeMux
+	admin *http.ServeMux
+}
+
+// A result is the JSON form of a geo.Result.
+type result struct {
+	IP       string     `json:"ip"`
+	Loc      *geo.Loc   `json:"loc,omitempty"`
+	AS       *geo.AS    `json:"as,omitempty"`
+	Route    *geo.Route `json:"route,omitempty"`
+	Fallback bool       `json:"fallback,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+func newServer(load func() (*geo.DB, error)) *server {
+	s := &server{
+		db:    geo.NewDBReloader(load),
+		mux:   http.NewServeMux(),
+		admin: http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/lookup/", s.lookupOne)
+	s.mux.HandleFunc("/lookup", s.lookupBatch)
+	s.mux.HandleFunc("/healthz", s.healthz)
+	s.mux.HandleFunc("/readyz", s.readyz)
+	s.admin.HandleFunc("/reload", s.reloadz)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// reload loads a new geo.DB and replaces the current one if it succeeds.
+func (s *server) reload() error {
+	return s.db.Reload()
+}
+
+func (s *server) current() *geo.DB {
+	return s.db.DB()
+}
+
+func (s *server) lookup(db *geo.DB, ip string) (result, int) {
+	res := result{IP: ip}
+	r, err := db.Lookup(ip)
+	switch err {
+	case nil:
+	case geo.ErrBadIP:
+		res.Error = err.Error()
+		return res, http.StatusBadRequest
+	case geo.ErrNotFound:
+		res.Error = err.Error()
+		return res, http.StatusNotFound
+	default:
+		res.Error = err.Error()
+		return res, http.StatusInternalServerError
+	}
+	res.Loc = r.Loc
+	res.AS = r.AS
+	res.Route = r.Route
+	res.Fallback = r.Fallback
+	return res, http.StatusOK
+}
+
+func (s *server) lookupOne(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	db := s.current()
+	if db == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	res, code := s.lookup(db, strings.TrimPrefix(r.URL.Path, "/lookup/"))
+	writeJSON(w, code, res)
+}
+
+func (s *server) lookupBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	db := s.current()
+	if db == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	var ips []string
+	body := http.MaxBytesReader(w, r.Body, maxBatchBody)
+	if err := json.NewDecoder(body).Decode(&ips); err != nil {
+		http.Error(w, "body must be a JSON array of addresses", http.StatusBadRequest)
+		return
+	}
+	if len(ips) > maxBatch {
+		http.Error(w, "too many addresses", http.StatusRequestEntityTooLarge)
+		return
+	}
+	rs := make([]result, len(ips))
+	for i, ip := range ips {
+		rs[i], _ = s.lookup(db, ip)
+	}
+	writeJSON(w, http.StatusOK, rs)
+}
+
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	if s.current() == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *server) reloadz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("geoipd: writing response: %v", err)
+	}
+}
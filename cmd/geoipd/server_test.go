@@ -0,0 +1,116 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.google.com/p/iptrie/geo"
+)
+
+const testdata = "../../geo/testdata/db"
+
+func get(t *testing.T, url string) (*http.Response, result) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res result
+	json.NewDecoder(resp.Body).Decode(&res)
+	return resp, res
+}
+
+func TestServer(t *testing.T) {
+	fail := false
+	s := newServer(func() (*geo.DB, error) {
+		if fail {
+			return nil, errors.New("load failed")
+		}
+		return geo.OpenDB(testdata)
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	admin := httptest.NewServer(s.admin)
+	defer admin.Close()
+
+	resp, _ := get(t, ts.URL+"/readyz")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readyz before load = %d", resp.StatusCode)
+	}
+	resp, _ = get(t, ts.URL+"/lookup/8.8.8.8")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("lookup before load = %d", resp.StatusCode)
+	}
+	resp, err := http.Post(ts.URL+"/reload", "", nil)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("reload on the public listener = %v, %v", resp, err)
+	}
+	resp, err = http.Post(admin.URL+"/reload", "", nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload = %v, %v", resp, err)
+	}
+	resp, _ = get(t, ts.URL+"/readyz")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("readyz after load = %d", resp.StatusCode)
+	}
+	resp, _ = get(t, ts.URL+"/healthz")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz = %d", resp.StatusCode)
+	}
+
+	resp, res := get(t, ts.URL+"/lookup/8.8.8.8")
+	if resp.StatusCode != http.StatusOK || res.Loc == nil || res.Loc.City != "Mountain View" || res.AS == nil || res.AS.Num != 15169 {
+		t.Errorf("lookup 8.8.8.8 = %d %+v", resp.StatusCode, res)
+	}
+	resp, res = get(t, ts.URL+"/lookup/9.1.2.3")
+	if resp.StatusCode != http.StatusOK || !res.Fallback || res.Loc.CountryCode != "US" {
+		t.Errorf("lookup 9.1.2.3 = %d %+v", resp.StatusCode, res)
+	}
+	resp, _ = get(t, ts.URL+"/lookup/127.0.0.1")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("lookup 127.0.0.1 = %d", resp.StatusCode)
+	}
+	resp, _ = get(t, ts.URL+"/lookup/nonsense")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("lookup nonsense = %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(ts.URL+"/lookup", "application/json", strings.NewReader(`["8.8.8.8","2001:4860:4860::8888","x"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs []result
+	json.NewDecoder(resp.Body).Decode(&rs)
+	resp.Body.Close()
+	if len(rs) != 3 || rs[0].Loc == nil || rs[1].AS == nil || rs[1].AS.Num != 15169 || rs[2].Error == "" {
+		t.Errorf("batch lookup = %+v", rs)
+	}
+	big := `["` + strings.Repeat("1", maxBatchBody) + `"]`
+	resp, err = http.Post(ts.URL+"/lookup", "application/json", strings.NewReader(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("oversized batch lookup = %d", resp.StatusCode)
+	}
+
+	// a failed reload keeps the old data
+	fail = true
+	resp, _ = http.Post(admin.URL+"/reload", "", nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("failed reload = %d", resp.StatusCode)
+	}
+	resp, _ = get(t, ts.URL+"/lookup/8.8.8.8")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("lookup after failed reload = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Iptrie is a tool for ad hoc lookups in geolocation data and for converting
+// it between formats.
+//
+// Usage:
+//
+//	iptrie lookup [-db path] [ip ...]
+//	iptrie build [-db dir] -o snapshot
+//	iptrie compress -in ranges.csv -csv out.csv -bin out.bin
+//	iptrie stats [-db path]
+//	iptrie diff old new
+//
+// A db path is either a directory holding the maxmind CSV files, see
+// geo.OpenDB, or a snapshot written by build.  Lookup reads addresses from
+// standard input, one per line, when none are given as arguments.  Diff exits
+// with status 1 when the two databases differ.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"code.google.com/p/iptrie"
+	"code.google.com/p/iptrie/geo"
+	"code.google.com/p/iptrie/geo/util"
+)
+
+const usage = `usage:
+	iptrie lookup [-db path] [ip ...]
+	iptrie build [-db dir] -o snapshot
+	iptrie compress -in ranges.csv -csv out.csv -bin out.bin
+	iptrie stats [-db path]
+	iptrie diff old new
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes a subcommand and returns the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	var cmd func(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error
+	switch args[0] {
+	case "lookup":
+		cmd = lookup
+	case "build":
+		cmd = build
+	case "compress":
+		cmd = compress
+	case "stats":
+		cmd = stats
+	case "diff":
+		cmd = diff
+	default:
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	err := cmd(fs, args[1:], stdin, stdout)
+	switch err {
+	case nil:
+		return 0
+	case flag.ErrHelp:
+		return 2
+	case errDiffer:
+		return 1
+	}
+	fmt.Fprintf(stderr, "iptrie %s: %v\n", args[0], err)
+	return 2
+}
+
+// openDB loads a directory of maxmind files or a snapshot.
+func openDB(path string) (*geo.DB, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return geo.OpenDB(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return geo.ReadSnapshot(bufio.NewReader(f))
+}
+
+func lookup(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	path := fs.String("db", ".", "maxmind directory or snapshot")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := openDB(*path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+	show := func(ip string) {
+		r, err := db.Lookup(ip)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%v\n", ip, err)
+			return
+		}
+		loc, as := "-", "-"
+		if r.Loc != nil {
+			loc = describe(r.Loc)
+		}
+		if r.Route != nil {
+			as = describe(r.Route)
+		} else if r.AS != nil {
+			as = describe(r.AS)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", ip, loc, as)
+	}
+	if fs.NArg() > 0 {
+		for _, ip := range fs.Args() {
+			show(ip)
+		}
+		return nil
+	}
+	s := bufio.NewScanner(stdin)
+	for s.Scan() {
+		if ip := strings.TrimSpace(s.Text()); ip != "" {
+			show(ip)
+		}
+	}
+	return s.Err()
+}
+
+func build(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	dir := fs.String("db", ".", "maxmind directory")
+	out := fs.String("o", "", "snapshot to write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("-o is required")
+	}
+	db, err := openDB(*dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = geo.WriteSnapshot(w, db)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func compress(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	in := fs.String("in", "", "range location CSV to read")
+	csvOut := fs.String("csv", "", "compressed CSV to write")
+	binOut := fs.String("bin", "", "compressed binary file to write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" || *csvOut == "" || *binOut == "" {
+		return fmt.Errorf("-in, -csv and -bin are required")
+	}
+	sum, err := util.CompressRangeLocationFiles(*in, *csvOut, *binOut)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d ranges read, %d written\n", sum.Read, sum.Written)
+	return nil
+}
+
+func stats(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	path := fs.String("db", ".", "maxmind directory or snapshot")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := openDB(*path)
+	if err != nil {
+		return err
+	}
+	for _, nt := range tries(db) {
+		var n4, n6 int
+		values := make(map[interface{}]bool)
+		nt.t.Walk(func(r iptrie.Range) bool {
+			if r.Start.To4() != nil {
+				n4++
+			} else {
+				n6++
+			}
+			values[r.Data] = true
+			return true
+		})
+		fmt.Fprintf(stdout, "%-8s %d ranges (%d IPv4, %d IPv6), %d distinct values\n",
+			nt.name+":", n4+n6, n4, n6, len(values))
+	}
+	return nil
+}
+
+var errDiffer = errors.New("databases differ")
+
+func diff(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("need two databases")
+	}
+	a, err := openDB(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := openDB(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+	ta, tb := tries(a), tries(b)
+	differ := false
+	for i := range ta {
+		ra, rb := ranges(ta[i].t), ranges(tb[i].t)
+		name := ta[i].name
+		for len(ra) > 0 || len(rb) > 0 {
+			switch c := compareRanges(ra, rb); {
+			case c < 0:
+				fmt.Fprintf(w, "- %s %s\n", name, formatRange(ra[0]))
+				ra = ra[1:]
+			case c > 0:
+				fmt.Fprintf(w, "+ %s %s\n", name, formatRange(rb[0]))
+				rb = rb[1:]
+			default:
+				if describe(ra[0].Data) != describe(rb[0].Data) {
+					fmt.Fprintf(w, "~ %s %s -> %s\n", name, formatRange(ra[0]), describe(rb[0].Data))
+					differ = true
+				}
+				ra, rb = ra[1:], rb[1:]
+				continue
+			}
+			differ = true
+		}
+	}
+	if differ {
+		return errDiffer
+	}
+	return nil
+}
+
+type namedTrie struct {
+	name string
+	t    *iptrie.IPTrie
+}
+
+func tries(db *geo.DB) []namedTrie {
+	return []namedTrie{
+		{"city", db.City},
+		{"country", db.Country},
+		{"asn", db.ASN},
+	}
+}
+
+func ranges(t *iptrie.IPTrie) []iptrie.Range {
+	var rs []iptrie.Range
+	t.Walk(func(r iptrie.Range) bool {
+		rs = append(rs, r)
+		return true
+	})
+	return rs
+}
+
+// compareRanges orders the first ranges of two lists by start and end
+// address.  An empty list sorts after everything.
+func compareRanges(a, b []iptrie.Range) int {
+	if len(a) == 0 {
+		return 1
+	}
+	if len(b) == 0 {
+		return -1
+	}
+	if c := strings.Compare(string(a[0].Start), string(b[0].Start)); c != 0 {
+		return c
+	}
+	return strings.Compare(string(a[0].End), string(b[0].End))
+}
+
+func formatRange(r iptrie.Range) string {
+	return fmt.Sprintf("%s-%s %s", r.Start, r.End, describe(r.Data))
+}
+
+func describe(d interface{}) string {
+	switch v := d.(type) {
+	case *geo.Loc:
+		return fmt.Sprintf("%s/%s/%s (%g,%g)", v.CountryCode, v.Region, v.City, v.Lat, v.Lon)
+	case *geo.AS:
+		return fmt.Sprintf("AS%d %s", v.Num, v.Dsc)
+	case *geo.Route:
+		return fmt.Sprintf("AS%d %s path %v", v.Num, v.Prefix, v.Path)
+	}
+	return fmt.Sprint(d)
+}
@@ -0,0 +1,99 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testdata = "../../geo/testdata/db"
+
+func runCmd(t *testing.T, stdin string, args ...string) (string, int) {
+	var out, errOut bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &out, &errOut)
+	if code == 2 {
+		t.Logf("iptrie %v: %s", args, errOut.String())
+	}
+	return out.String(), code
+}
+
+func TestLookup(t *testing.T) {
+	out, code := runCmd(t, "8.8.8.8\n\n9.1.2.3\n", "lookup", "-db", testdata)
+	if code != 0 {
+		t.Fatalf("lookup exited with %d", code)
+	}
+	want := "8.8.8.8\tUS/CA/Mountain View (37.4192,-122.0574)\tAS15169 Google Inc.\n" +
+		"9.1.2.3\tUS// (38,-97)\t-\n"
+	if out != want {
+		t.Errorf("lookup = %q, want %q", out, want)
+	}
+	out, _ = runCmd(t, "", "lookup", "-db", testdata, "127.0.0.1")
+	if !strings.Contains(out, "no data") {
+		t.Errorf("lookup = %q", out)
+	}
+}
+
+func TestBuildStatsDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptrie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snap := filepath.Join(dir, "db.snap")
+	if _, code := runCmd(t, "", "build", "-db", testdata, "-o", snap); code != 0 {
+		t.Fatalf("build exited with %d", code)
+	}
+
+	out, code := runCmd(t, "", "stats", "-db", snap)
+	if code != 0 {
+		t.Fatalf("stats exited with %d", code)
+	}
+	if !strings.Contains(out, "city:    4 ranges (3 IPv4, 1 IPv6), 4 distinct values") {
+		t.Errorf("stats = %q", out)
+	}
+
+	if out, code = runCmd(t, "", "diff", testdata, snap); code != 0 || out != "" {
+		t.Errorf("diff of equal databases = %d %q", code, out)
+	}
+
+	// a copy of the data with one range removed and one location changed
+	other := filepath.Join(dir, "other")
+	os.Mkdir(other, 0755)
+	files, _ := filepath.Glob(filepath.Join(testdata, "*.csv"))
+	for _, f := range files {
+		b, _ := ioutil.ReadFile(f)
+		s := string(b)
+		switch filepath.Base(f) {
+		case "GeoLiteCity-Blocks.csv":
+			s = strings.Replace(s, "\"16777216\",\"16777471\",\"2\"\n", "", 1)
+		case "GeoLiteCity-Location.csv":
+			s = strings.Replace(s, "Toronto", "Ottawa", 1)
+		}
+		ioutil.WriteFile(filepath.Join(other, filepath.Base(f)), []byte(s), 0644)
+	}
+	out, code = runCmd(t, "", "diff", snap, other)
+	if code != 1 {
+		t.Errorf("diff exited with %d", code)
+	}
+	want := "- city 1.0.0.0-1.0.0.255 AU/07/Melbourne (-37.8139,144.9634)\n" +
+		"~ city 67.202.0.0-67.202.3.255 CA/ON/Toronto (43.6667,-79.4167) -> CA/ON/Ottawa (43.6667,-79.4167)\n"
+	if out != want {
+		t.Errorf("diff = %q, want %q", out, want)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	if _, code := runCmd(t, "", "frobnicate"); code != 2 {
+		t.Errorf("unknown command exited with %d", code)
+	}
+	if _, code := runCmd(t, "", "build"); code != 2 {
+		t.Errorf("build without -o exited with %d", code)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"code.google.com/p/iptrie"
+)
+
+// Archive formats, chosen by the suffix of the archive name.
+const (
+	plainFile = iota
+	zipFile
+	gzipFile
+	tarFile
+	tarGzipFile
+)
+
+// An Archive gives access to the files in a .zip, .gz, .tar or .tar.gz (.tgz)
+// archive as they are distributed by maxmind and the RIRs.  Members are found
+// by a pattern on their base name and are decompressed as they are read, so
+// nothing is unpacked to disk.  Any other file is treated as an archive with a
+// single member.
+type Archive struct {
+	name   string
+	format int
+	zr     *zip.Reader
+	raw    func() (io.ReadCloser, error) // the archive from its first byte
+	closer io.Closer
+}
+
+// OpenArchive opens the named archive file.  Tar and gzip archives are
+// reopened for every member that is opened.
+func OpenArchive(name string) (*Archive, error) {
+	a := &Archive{
+		name:   name,
+		format: archiveFormat(name),
+	}
+	if a.format == zipFile {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		a.zr = &zr.Reader
+		a.closer = zr
+		return a, nil
+	}
+	if _, err := os.Stat(name); err != nil {
+		return nil, err
+	}
+	a.raw = func() (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+	return a, nil
+}
+
+// NewArchive reads an archive from r.  The name, usually the name of the file
+// that was downloaded, selects the archive format.  If r is not an io.Seeker,
+// or for zip archives an io.ReaderAt, it is read into memory first.  Members of
+// an archive read from an io.Seeker must be read one at a time.
+func NewArchive(r io.Reader, name string) (*Archive, error) {
+	a := &Archive{
+		name:   name,
+		format: archiveFormat(name),
+	}
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		rs = bytes.NewReader(b)
+	}
+	if a.format == zipFile {
+		ra, ok := rs.(io.ReaderAt)
+		if !ok {
+			b, err := ioutil.ReadAll(rs)
+			if err != nil {
+				return nil, err
+			}
+			ra = bytes.NewReader(b)
+		}
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		a.zr, err = zip.NewReader(ra, size)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	a.raw = func() (io.ReadCloser, error) {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(rs), nil
+	}
+	return a, nil
+}
+
+func archiveFormat(name string) int {
+	n := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(n, ".zip"):
+		return zipFile
+	case strings.HasSuffix(n, ".tar.gz"), strings.HasSuffix(n, ".tgz"):
+		return tarGzipFile
+	case strings.HasSuffix(n, ".tar"):
+		return tarFile
+	case strings.HasSuffix(n, ".gz"):
+		return gzipFile
+	}
+	return plainFile
+}
+
+// Close releases the resources held by the Archive.
+func (a *Archive) Close() error {
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+// Open returns the first member of the archive whose base name matches the
+// pattern, using the syntax of path.Match.  The caller must close it.
+func (a *Archive) Open(pattern string) (io.ReadCloser, error) {
+	if a.format == zipFile {
+		for _, f := range a.zr.File {
+			if match(pattern, f.Name) && !f.FileInfo().IsDir() {
+				return f.Open()
+			}
+		}
+		return nil, a.notFound(pattern)
+	}
+
+	raw, err := a.raw()
+	if err != nil {
+		return nil, err
+	}
+	m := &member{
+		Reader:  raw,
+		closers: []io.Closer{raw},
+	}
+	if a.format == gzipFile || a.format == tarGzipFile {
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.Reader = zr
+		m.closers = append(m.closers, zr)
+		if a.format == gzipFile {
+			name := zr.Name
+			if name == "" {
+				name = a.name[:len(a.name)-len(".gz")]
+			}
+			if !match(pattern, name) {
+				m.Close()
+				return nil, a.notFound(pattern)
+			}
+			return m, nil
+		}
+	}
+	if a.format == plainFile {
+		if !match(pattern, a.name) {
+			m.Close()
+			return nil, a.notFound(pattern)
+		}
+		return m, nil
+	}
+
+	tr := tar.NewReader(m.Reader)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			m.Close()
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && match(pattern, h.Name) {
+			m.Reader = tr
+			return m, nil
+		}
+	}
+	m.Close()
+	return nil, a.notFound(pattern)
+}
+
+func (a *Archive) notFound(pattern string) error {
+	return fmt.Errorf("geo: no file matching %q in %s", pattern, a.name)
+}
+
+func match(pattern, name string) bool {
+	ok, _ := path.Match(pattern, path.Base(name))
+	return ok
+}
+
+// A member is a file being read from an archive.
+type member struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *member) Close() error {
+	var err error
+	for i := len(m.closers) - 1; i >= 0; i-- {
+		if e := m.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// AddMaxmindIPv4CityArchive finds the block and location files of the maxmind
+// IPv4 city database in the archive by their name patterns, for example
+// "*City-Blocks.csv" and "*City-Location.csv", and adds them to the IPTrie as
+// AddMaxmindIPv4City does.
+func (l *Loader) AddMaxmindIPv4CityArchive(t *iptrie.IPTrie, a *Archive, blockPattern, locationPattern string) error {
+	return l.addArchive(a, blockPattern, locationPattern, func(block, location io.Reader) error {
+		return l.AddMaxmindIPv4City(t, block, location)
+	})
+}
+
+// AddMaxmindIPv4CountryArchive finds the block and location files of the
+// maxmind IPv4 country database in the archive by their name patterns and adds
+// them to the IPTrie as AddMaxmindIPv4Country does.
+func (l *Loader) AddMaxmindIPv4CountryArchive(t *iptrie.IPTrie, a *Archive, blockPattern, locationPattern string) error {
+	return l.addArchive(a, blockPattern, locationPattern, func(block, location io.Reader) error {
+		return l.AddMaxmindIPv4Country(t, block, location)
+	})
+}
+
+// addArchive opens the location file before the block file since that is the
+// order the loaders read them in.  The location file is read into memory so
+// that only one member is open at a time.
+func (l *Loader) addArchive(a *Archive, blockPattern, locationPattern string, add func(block, location io.Reader) error) error {
+	lf, err := a.Open(locationPattern)
+	if err != nil {
+		return err
+	}
+	location, err := ioutil.ReadAll(lf)
+	lf.Close()
+	if err != nil {
+		return err
+	}
+	bf, err := a.Open(blockPattern)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+	return add(bf, bytes.NewReader(location))
+}
@@ -0,0 +1,138 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/iptrie"
+)
+
+var cityFiles = []struct {
+	name string
+	data string
+}{
+	{"GeoLiteCity_20131001/README.txt", "GeoLite City"},
+	{"GeoLiteCity_20131001/GeoLiteCity-Blocks.csv", blocks},
+	{"GeoLiteCity_20131001/GeoLiteCity-Location.csv", location},
+}
+
+func zipCity(t *testing.T) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, f := range cityFiles {
+		fw, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func tarGzipCity(t *testing.T) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	w := tar.NewWriter(zw)
+	for _, f := range cityFiles {
+		h := &tar.Header{
+			Name:     f.name,
+			Mode:     0644,
+			Size:     int64(len(f.data)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	return b.Bytes()
+}
+
+func checkCity(t *testing.T, name string, a *Archive) {
+	ipt := iptrie.NewIPTrie()
+	l := &Loader{Strict: true}
+	err := l.AddMaxmindIPv4CityArchive(ipt, a, "*-Blocks.csv", "*-Location.csv")
+	if err != nil {
+		t.Fatalf("%s: AddMaxmindIPv4CityArchive: %v", name, err)
+	}
+	if l.Report.Loaded != 3 {
+		t.Errorf("%s: Loaded = %d, want 3", name, l.Report.Loaded)
+	}
+	if ipt.Get("192.168.8.8") == nil {
+		t.Errorf("%s: 192.168.8.8 not loaded", name)
+	}
+	if _, err = a.Open("*-Blocks-IPv6.csv"); err == nil {
+		t.Errorf("%s: Open: expected error", name)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string][]byte{
+		"GeoLiteCity.zip":    zipCity(t),
+		"GeoLiteCity.tar.gz": tarGzipCity(t),
+	} {
+		// a stream that must be buffered
+		a, err := NewArchive(ioutil.NopCloser(bytes.NewReader(data)), name)
+		if err != nil {
+			t.Fatalf("%s: NewArchive: %v", name, err)
+		}
+		checkCity(t, name, a)
+
+		p := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		a, err = OpenArchive(p)
+		if err != nil {
+			t.Fatalf("%s: OpenArchive: %v", name, err)
+		}
+		checkCity(t, name, a)
+		a.Close()
+	}
+}
+
+func TestArchiveGzip(t *testing.T) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(blocks))
+	zw.Close()
+	a, err := NewArchive(bytes.NewReader(b.Bytes()), "/tmp/GeoLiteCity-Blocks.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := a.Open("*-Blocks.csv")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	d, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(d) != blocks {
+		t.Errorf("Open = %q, %v", d, err)
+	}
+	if _, err = a.Open("*-Location.csv"); err == nil {
+		t.Errorf("Open: expected error")
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/iptrie"
+)
+
+// A Route represents a prefix announced in a BGP routing table.  The embedded
+// AS holds the origin AS, which is the last AS in the path.
+type Route struct {
+	AS
+	Prefix string  // announced prefix in CIDR notation
+	Path   []int64 // AS path as seen by the peer, origin last
+}
+
+// MRT types and subtypes used by TABLE_DUMP_V2 (RFC 6396).
+const (
+	mrtTableDumpV2      = 13
+	mrtRIBIPv4Unicast   = 2
+	mrtRIBIPv6Unicast   = 4
+	bgpAttrASPath       = 2
+	bgpAttrExtendedLen  = 0x10
+	bgpASPathSegmentSet = 1
+	mrtMaxRecord        = 1 << 20 // larger records are rejected as corrupt
+)
+
+var (
+	errShortMRT = errors.New("geo: truncated MRT record")
+	errBigMRT   = errors.New("geo: MRT record too large")
+)
+
+// AddBGPDumpASN reads the one-line-per-route output of "bgpdump -m" and adds a
+// *Route for every announced prefix to the IPTrie.  When prefixes overlap the
+// most specific one is returned on lookup.  When a prefix is seen from several
+// peers the first occurrence is kept.
+func AddBGPDumpASN(t *iptrie.IPTrie, dump io.Reader) error {
+	var rs []*Route
+	s := bufio.NewScanner(dump)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		r := strings.Split(s.Text(), "|")
+		if len(r) < 7 || (r[2] != "B" && r[2] != "A") {
+			continue
+		}
+		p, err := parseASPath(r[6])
+		if err != nil || len(p) == 0 {
+			continue
+		}
+		rs = append(rs, newRoute(r[5], p))
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return addRoutes(t, rs)
+}
+
+// AddMRTASN reads the RIB entries of an MRT TABLE_DUMP_V2 file and adds a
+// *Route for every IPv4 and IPv6 unicast prefix to the IPTrie.  The AS path of
+// the first RIB entry for each prefix is used.  Other MRT record types are
+// skipped.
+func AddMRTASN(t *iptrie.IPTrie, mrt io.Reader) error {
+	var rs []*Route
+	var h [12]byte
+	for {
+		_, err := io.ReadFull(mrt, h[:])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errShortMRT
+		}
+		typ := binary.BigEndian.Uint16(h[4:6])
+		sub := binary.BigEndian.Uint16(h[6:8])
+		l := binary.BigEndian.Uint32(h[8:12])
+		if l > mrtMaxRecord {
+			return errBigMRT
+		}
+		b := make([]byte, l)
+		if _, err = io.ReadFull(mrt, b); err != nil {
+			return errShortMRT
+		}
+		if typ != mrtTableDumpV2 {
+			continue
+		}
+		var al int
+		switch sub {
+		case mrtRIBIPv4Unicast:
+			al = net.IPv4len
+		case mrtRIBIPv6Unicast:
+			al = net.IPv6len
+		default:
+			continue
+		}
+		r, err := parseRIB(b, al)
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			rs = append(rs, r)
+		}
+	}
+	return addRoutes(t, rs)
+}
+
+// parseRIB decodes a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record body.  The
+// result is nil if none of the entries carries an AS path.
+func parseRIB(b []byte, al int) (*Route, error) {
+	if len(b) < 5 {
+		return nil, errShortMRT
+	}
+	pl := int(b[4])
+	n := (pl + 7) / 8
+	if pl > al*8 || len(b) < 5+n+2 {
+		return nil, errShortMRT
+	}
+	ip := make(net.IP, al)
+	copy(ip, b[5:5+n])
+	prefix := fmt.Sprintf("%s/%d", ip, pl)
+	count := int(binary.BigEndian.Uint16(b[5+n:]))
+	b = b[5+n+2:]
+	for i := 0; i < count; i++ {
+		if len(b) < 8 {
+			return nil, errShortMRT
+		}
+		l := int(binary.BigEndian.Uint16(b[6:8]))
+		if len(b) < 8+l {
+			return nil, errShortMRT
+		}
+		p, err := parseAttrs(b[8 : 8+l])
+		if err != nil {
+			return nil, err
+		}
+		if len(p) > 0 {
+			return newRoute(prefix, p), nil
+		}
+		b = b[8+l:]
+	}
+	return nil, nil
+}
+
+// parseAttrs returns the AS path found in a list of BGP path attributes.  ASNs
+// in TABLE_DUMP_V2 are always four bytes long.
+func parseAttrs(b []byte) ([]int64, error) {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errShortMRT
+		}
+		flags, typ := b[0], b[1]
+		var l int
+		if flags&bgpAttrExtendedLen != 0 {
+			if len(b) < 4 {
+				return nil, errShortMRT
+			}
+			l = int(binary.BigEndian.Uint16(b[2:4]))
+			b = b[4:]
+		} else {
+			l = int(b[2])
+			b = b[3:]
+		}
+		if len(b) < l {
+			return nil, errShortMRT
+		}
+		if typ == bgpAttrASPath {
+			return parseSegments(b[:l])
+		}
+		b = b[l:]
+	}
+	return nil, nil
+}
+
+func parseSegments(b []byte) ([]int64, error) {
+	var p []int64
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errShortMRT
+		}
+		n := int(b[1])
+		if len(b) < 2+4*n {
+			return nil, errShortMRT
+		}
+		for i := 0; i < n; i++ {
+			p = append(p, int64(binary.BigEndian.Uint32(b[2+4*i:])))
+		}
+		b = b[2+4*n:]
+	}
+	return p, nil
+}
+
+// parseASPath parses a textual AS path such as "4777 2516 {15169,36040}".
+// Members of an AS set are appended to the path in the order given.
+func parseASPath(s string) ([]int64, error) {
+	var p []int64
+	for _, f := range strings.Fields(s) {
+		f = strings.Trim(f, "{}")
+		for _, a := range strings.Split(f, ",") {
+			if a == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(a, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, n)
+		}
+	}
+	return p, nil
+}
+
+func newRoute(prefix string, p []int64) *Route {
+	return &Route{
+		AS:     AS{Num: p[len(p)-1]},
+		Prefix: prefix,
+		Path:   p,
+	}
+}
+
+type prefixRange struct {
+	s, e net.IP
+	r    *Route
+}
+
+// addRoutes flattens overlapping prefixes into disjoint ranges, each owned by
+// the most specific prefix covering it, and adds them to the IPTrie.  The
+// IPTrie does not handle nested ranges on its own.
+func addRoutes(t *iptrie.IPTrie, rs []*Route) error {
+	seen := make(map[string]bool)
+	var ps []prefixRange
+	for _, r := range rs {
+		_, n, err := net.ParseCIDR(r.Prefix)
+		if err != nil {
+			return fmt.Errorf("geo: bad prefix %q", r.Prefix)
+		}
+		r.Prefix = n.String()
+		if seen[r.Prefix] {
+			continue
+		}
+		seen[r.Prefix] = true
+		s := n.IP.To16()
+		e := make(net.IP, net.IPv6len)
+		d := net.IPv6len - len(n.Mask)
+		for i := range e {
+			e[i] = s[i]
+			if i >= d {
+				e[i] |= ^n.Mask[i-d]
+			}
+		}
+		ps = append(ps, prefixRange{s, e, r})
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if c := bytes.Compare(ps[i].s, ps[j].s); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(ps[i].e, ps[j].e) > 0
+	})
+
+	var stack []prefixRange
+	var cur net.IP
+	done := false
+	emit := func(e net.IP, r *Route) {
+		if !done && bytes.Compare(cur, e) <= 0 {
+			t.AddRangeIp(cur, e, r)
+		}
+		cur, done = nextIP(e)
+	}
+	for _, p := range ps {
+		for len(stack) > 0 && bytes.Compare(stack[len(stack)-1].e, p.s) < 0 {
+			emit(stack[len(stack)-1].e, stack[len(stack)-1].r)
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 && bytes.Compare(cur, p.s) < 0 {
+			e, _ := prevIP(p.s)
+			emit(e, stack[len(stack)-1].r)
+		}
+		cur, done = p.s, false
+		stack = append(stack, p)
+	}
+	for len(stack) > 0 {
+		emit(stack[len(stack)-1].e, stack[len(stack)-1].r)
+		stack = stack[:len(stack)-1]
+	}
+	return nil
+}
+
+// nextIP returns the address following ip and whether it wrapped around.
+func nextIP(ip net.IP) (net.IP, bool) {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return n, false
+		}
+	}
+	return n, true
+}
+
+// prevIP returns the address preceding ip and whether it wrapped around.
+func prevIP(ip net.IP) (net.IP, bool) {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]--
+		if n[i] != 0xff {
+			return n, false
+		}
+	}
+	return n, true
+}
@@ -0,0 +1,183 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+
+	"code.google.com/p/iptrie"
+)
+
+var routeTests = []struct {
+	ip     string
+	origin int64
+	prefix string
+}{
+	{"10.0.5.5", 100, "10.0.0.0/8"},
+	{"10.1.0.0", 200, "10.1.0.0/16"},
+	{"10.1.5.5", 200, "10.1.0.0/16"},
+	{"10.1.2.7", 300, "10.1.2.0/24"},
+	{"10.1.2.255", 300, "10.1.2.0/24"},
+	{"10.1.3.0", 200, "10.1.0.0/16"},
+	{"10.2.0.0", 100, "10.0.0.0/8"},
+	{"10.200.7.1", 100, "10.0.0.0/8"},
+	{"10.255.255.255", 100, "10.0.0.0/8"},
+	{"11.0.0.1", 0, ""},
+	{"9.255.255.255", 0, ""},
+	{"2001:db8::1", 400, "2001:db8::/32"},
+	{"2001:db8:1::1", 500, "2001:db8:1::/48"},
+	{"2001:db8:2::1", 400, "2001:db8::/32"},
+	{"2001:db9::1", 0, ""},
+}
+
+func checkRoutes(t *testing.T, ipt *iptrie.IPTrie) {
+	for _, tt := range routeTests {
+		i := ipt.Get(tt.ip)
+		if tt.prefix == "" {
+			if i != nil {
+				t.Errorf("%s Route = %v, want nil", tt.ip, i)
+			}
+			continue
+		}
+		r, ok := i.(*Route)
+		if !ok {
+			t.Errorf("%s Route = %v, want %s", tt.ip, i, tt.prefix)
+			continue
+		}
+		if r.Num != tt.origin || r.Prefix != tt.prefix {
+			t.Errorf("%s Route = %d %s, want %d %s", tt.ip, r.Num, r.Prefix, tt.origin, tt.prefix)
+		}
+	}
+}
+
+func TestBGPDumpASN(t *testing.T) {
+	f, err := os.Open("testdata/bgpdump.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ipt := iptrie.NewIPTrie()
+	if err = AddBGPDumpASN(ipt, f); err != nil {
+		t.Fatalf("AddBGPDumpASN: %v", err)
+	}
+	checkRoutes(t, ipt)
+	r := ipt.Get("10.0.0.1").(*Route)
+	if len(r.Path) != 3 || r.Path[0] != 4777 {
+		t.Errorf("10.0.0.1 Path = %v, want first peer's path", r.Path)
+	}
+}
+
+func TestMRTASN(t *testing.T) {
+	f, err := os.Open("testdata/rib.mrt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ipt := iptrie.NewIPTrie()
+	if err = AddMRTASN(ipt, f); err != nil {
+		t.Fatalf("AddMRTASN: %v", err)
+	}
+	checkRoutes(t, ipt)
+
+	// A corrupt header must not make AddMRTASN allocate 4GB.
+	h := []byte{0, 0, 0, 0, 0, 13, 0, 2, 0xff, 0xff, 0xff, 0xff}
+	if err = AddMRTASN(iptrie.NewIPTrie(), bytes.NewReader(h)); err != errBigMRT {
+		t.Errorf("AddMRTASN(huge record) = %v, want %v", err, errBigMRT)
+	}
+}
+
+func TestParseASPath(t *testing.T) {
+	p, err := parseASPath("4777 2516 {15169,36040}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 4 || p[3] != 36040 {
+		t.Errorf("parseASPath = %v", p)
+	}
+	if _, err = parseASPath("4777 x"); err == nil {
+		t.Errorf("parseASPath: expected error")
+	}
+}
+
+func TestNestedRoutes(t *testing.T) {
+	tr := iptrie.NewIPTrie()
+	err := addRoutes(tr, []*Route{
+		newRoute("10.1.0.0/20", []int64{112}),
+		newRoute("10.1.2.96/27", []int64{121}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		addr string
+		as   int64
+	}{
+		{"10.1.0.0", 112},
+		{"10.1.2.0", 112},
+		{"10.1.2.95", 112},
+		{"10.1.2.96", 121},
+		{"10.1.2.118", 121},
+		{"10.1.2.127", 121},
+		{"10.1.2.128", 112},
+		{"10.1.15.255", 112},
+		{"10.1.16.0", 0},
+	}
+	for _, tt := range tests {
+		r, _ := tr.Get(tt.addr).(*Route)
+		if r == nil && tt.as != 0 || r != nil && r.Num != tt.as {
+			t.Errorf("Get(%s) = %v, want AS%d", tt.addr, r, tt.as)
+		}
+	}
+}
+
+// TestRoutesLongestPrefix compares lookups in random nested routing tables
+// with a brute force longest prefix match.
+func TestRoutesLongestPrefix(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		var rs []*Route
+		var nets []*net.IPNet
+		for i := 0; i < 30; i++ {
+			ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)))
+			_, n, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", ip, 14+r.Intn(17)))
+			rs = append(rs, newRoute(n.String(), []int64{int64(i + 1)}))
+			nets = append(nets, n)
+		}
+		tr := iptrie.NewIPTrie()
+		if err := addRoutes(tr, rs); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)))
+			if i%4 == 0 {
+				// Addresses at the edges of prefixes.
+				n := nets[r.Intn(len(nets))]
+				ip = n.IP.To16()
+				if r.Intn(2) == 0 {
+					ip, _ = prevIP(ip)
+				}
+			}
+			var want *Route
+			best := -1
+			for j, n := range nets {
+				if l, _ := n.Mask.Size(); n.Contains(ip) && l >= best {
+					if l > best || want == nil {
+						want = rs[j]
+					}
+					best = l
+				}
+			}
+			got, _ := tr.Get(ip.String()).(*Route)
+			if want == nil && got != nil || want != nil && (got == nil || got.Prefix != want.Prefix) {
+				t.Fatalf("round %d: Get(%s) = %v, want %v", round, ip, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"code.google.com/p/iptrie"
+)
+
+var (
+	ErrBadIP    = errors.New("geo: invalid IP address")
+	ErrNotFound = errors.New("geo: no data for IP address")
+	ErrNoData   = errors.New("geo: no database files found")
+)
+
+// A DB combines the city, country and ASN data for IPv4 and IPv6 addresses.
+// IPv4 and IPv6 ranges share the same IPTrie.  The country data is only used
+// when the city data has nothing for an address.
+type DB struct {
+	City    *iptrie.IPTrie // *Loc from the city databases
+	Country *iptrie.IPTrie // *Loc from the country database
+	ASN     *iptrie.IPTrie // *AS from the ASN databases or *Route from a routing table
+}
+
+// A Result is the information a DB has for an IP address.  Any of the fields
+// may be nil.
+type Result struct {
+	Loc      *Loc
+	AS       *AS
+	Route    *Route // set when the ASN data was loaded from a routing table
+	Fallback bool   // Loc came from the country data
+}
+
+// DBFiles names the files OpenDB looks for in a directory.  Files that are
+// missing are skipped.
+type DBFiles struct {
+	CityBlocks      string
+	CityLocation    string
+	CityIPv6        string
+	CountryBlocks   string
+	CountryLocation string
+	ASN             string
+	ASNIPv6         string
+}
+
+// DefaultDBFiles are the names of the maxmind GeoLite legacy files.
+var DefaultDBFiles = DBFiles{
+	CityBlocks:      "GeoLiteCity-Blocks.csv",
+	CityLocation:    "GeoLiteCity-Location.csv",
+	CityIPv6:        "GeoLiteCityv6.csv",
+	CountryBlocks:   "GeoIPCountryWhois.csv",
+	CountryLocation: "GeoIPCountry-Location.csv",
+	ASN:             "GeoIPASNum2.csv",
+	ASNIPv6:         "GeoIPASNum2v6.csv",
+}
+
+// NewDB creates a DB with empty tries.
+func NewDB() *DB {
+	return &DB{
+		City:    iptrie.NewIPTrie(),
+		Country: iptrie.NewIPTrie(),
+		ASN:     iptrie.NewIPTrie(),
+	}
+}
+
+// OpenDB loads the maxmind files named by DefaultDBFiles from dir with a
+// lenient Loader.
+func OpenDB(dir string) (*DB, error) {
+	return new(Loader).OpenDB(dir, DefaultDBFiles)
+}
+
+// OpenDB loads the files from dir into a new DB.  ErrNoData is returned if
+// none of the files exist.
+func (l *Loader) OpenDB(dir string, files DBFiles) (*DB, error) {
+	db := NewDB()
+	found := false
+	load := func(add func(in ...io.Reader) error, names ...string) error {
+		var in []io.Reader
+		for _, n := range names {
+			f, err := os.Open(filepath.Join(dir, n))
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = append(in, f)
+		}
+		found = true
+		return add(in...)
+	}
+	err := load(func(in ...io.Reader) error {
+		return l.AddMaxmindIPv4City(db.City, in[0], in[1])
+	}, files.CityBlocks, files.CityLocation)
+	if err != nil {
+		return nil, err
+	}
+	err = load(func(in ...io.Reader) error {
+		return l.AddMaxmindIPv6City(db.City, in[0])
+	}, files.CityIPv6)
+	if err != nil {
+		return nil, err
+	}
+	err = load(func(in ...io.Reader) error {
+		return l.AddMaxmindIPv4Country(db.Country, in[0], in[1])
+	}, files.CountryBlocks, files.CountryLocation)
+	if err != nil {
+		return nil, err
+	}
+	err = load(func(in ...io.Reader) error {
+		return l.AddMaxmindIPv4ASN(db.ASN, in[0])
+	}, files.ASN)
+	if err != nil {
+		return nil, err
+	}
+	err = load(func(in ...io.Reader) error {
+		return l.AddMaxmindIPv6ASN(db.ASN, in[0])
+	}, files.ASNIPv6)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNoData
+	}
+	return db, nil
+}
+
+// Lookup returns the location and AS of an IP address.  When the city data
+// has no location for the address the country data is used.  ErrNotFound is
+// returned if there is neither a location nor an AS for the address.
+func (db *DB) Lookup(ip string) (Result, error) {
+	var r Result
+	if net.ParseIP(ip) == nil {
+		return r, ErrBadIP
+	}
+	r.Loc, _ = get(db.City, ip).(*Loc)
+	if r.Loc == nil {
+		r.Loc, _ = get(db.Country, ip).(*Loc)
+		r.Fallback = r.Loc != nil
+	}
+	switch a := get(db.ASN, ip).(type) {
+	case *AS:
+		r.AS = a
+	case *Route:
+		r.AS = &a.AS
+		r.Route = a
+	}
+	if r.Loc == nil && r.AS == nil {
+		return r, ErrNotFound
+	}
+	return r, nil
+}
+
+func get(t *iptrie.IPTrie, ip string) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Get(ip)
+}
@@ -0,0 +1,81 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDBLookup(t *testing.T) {
+	db, err := OpenDB("testdata/db")
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	var lookupTests = []struct {
+		ip       string
+		country  string
+		city     string
+		asn      int64
+		fallback bool
+		err      error
+	}{
+		{"8.8.8.8", "US", "Mountain View", 15169, false, nil},
+		{"1.0.0.1", "AU", "Melbourne", 0, false, nil},
+		{"67.202.1.1", "CA", "Toronto", 577, false, nil},
+		{"9.1.2.3", "US", "", 0, true, nil},
+		{"24.48.3.4", "CA", "", 0, true, nil},
+		{"2001:4860:4860::8888", "US", "", 15169, false, nil},
+		{"127.0.0.1", "", "", 0, false, ErrNotFound},
+		{"8.8.8", "", "", 0, false, ErrBadIP},
+	}
+	for _, tt := range lookupTests {
+		r, err := db.Lookup(tt.ip)
+		if err != tt.err {
+			t.Errorf("Lookup(%s) error = %v, want %v", tt.ip, err, tt.err)
+			continue
+		}
+		if tt.country != "" && (r.Loc == nil || r.Loc.CountryCode != tt.country || r.Loc.City != tt.city) {
+			t.Errorf("Lookup(%s) Loc = %+v, want %s %s", tt.ip, r.Loc, tt.country, tt.city)
+		}
+		if r.Fallback != tt.fallback {
+			t.Errorf("Lookup(%s) Fallback = %v", tt.ip, r.Fallback)
+		}
+		if tt.asn != 0 && (r.AS == nil || r.AS.Num != tt.asn) {
+			t.Errorf("Lookup(%s) AS = %+v, want %d", tt.ip, r.AS, tt.asn)
+		}
+	}
+}
+
+func TestDBRoutes(t *testing.T) {
+	db := NewDB()
+	f, err := os.Open("testdata/bgpdump.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = AddBGPDumpASN(db.ASN, f); err != nil {
+		t.Fatal(err)
+	}
+	r, err := db.Lookup("10.1.2.3")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if r.AS == nil || r.AS.Num != 300 || r.Route == nil || r.Route.Prefix != "10.1.2.0/24" {
+		t.Errorf("Lookup = %+v", r)
+	}
+}
+
+func TestOpenDBEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = OpenDB(dir); err != ErrNoData {
+		t.Errorf("OpenDB = %v, want ErrNoData", err)
+	}
+}
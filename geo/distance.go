@@ -17,7 +17,7 @@ func deg2Rad(degree float64) float64 {
 	return (degree * math.Pi) / 180
 }
 
-//Distance computes the distance between two geolocations
+// Distance computes the distance between two geolocations
 func Distance(lat1, lon1, lat2, lon2 float64) float64 {
 
 	dlat := deg2Rad(lat2 - lat1)
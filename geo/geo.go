@@ -8,9 +8,10 @@
 package geo
 
 import (
-	"encoding/csv"
 	"io"
+	"net"
 	"strconv"
+	"strings"
 
 	"code.google.com/p/iptrie"
 )
@@ -34,207 +35,240 @@ type AS struct {
 // AddMaxmindIPv6ASN reads CSV information from the maxmind IPv6 ASN block
 // file and adds the appropriate ranges to the IPTrie.
 func AddMaxmindIPv6ASN(t *iptrie.IPTrie, block io.Reader) error {
-	c := csv.NewReader(block)
-	c.FieldsPerRecord = -1
-	c.TrailingComma = true
-	var a *AS
-	var r []string
-	var err error
-	for {
-		r, err = c.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
+	return new(Loader).AddMaxmindIPv6ASN(t, block)
+}
+
+// AddMaxmindIPv4ASN reads CSV information from the maxmind IPv4 ASN block
+// file and adds the appropriate ranges to the IPTrie.  Rows are either
+// start,end,"AS15169 Google Inc." as in GeoIPASNum2.csv or start,end,15169,
+// "Google Inc.".
+func AddMaxmindIPv4ASN(t *iptrie.IPTrie, block io.Reader) error {
+	return new(Loader).AddMaxmindIPv4ASN(t, block)
+}
+
+// AddMaxmindIPv6City reads CSV information from the maxmind IPv6 city block
+// file and adds the appropriate ranges to the IPTrie.
+func AddMaxmindIPv6City(t *iptrie.IPTrie, block io.Reader) error {
+	return new(Loader).AddMaxmindIPv6City(t, block)
+}
+
+// AddMaxmindIPv4City reads CSV information from the maxmind IPv4 city block
+// and location file and adds the appropriate ranges to the IPTrie.
+func AddMaxmindIPv4City(t *iptrie.IPTrie, block, location io.Reader) error {
+	return new(Loader).AddMaxmindIPv4City(t, block, location)
+}
+
+// AddMaxmindIPv4Country reads CSV information from the maxmind IPv4 country
+// block and location file and adds the appropriate ranges to the IPTrie.
+// Don't add this data with the city data, but instead use it in a separate
+// iptrie.IPTrie to fill in nil results, as a DB does.
+func AddMaxmindIPv4Country(t *iptrie.IPTrie, block, location io.Reader) error {
+	return new(Loader).AddMaxmindIPv4Country(t, block, location)
+}
+
+// AddMaxmindIPv6ASN is like the package level function of the same name but
+// reports bad rows through the Loader.
+func (l *Loader) AddMaxmindIPv6ASN(t *iptrie.IPTrie, block io.Reader) error {
+	return l.readRanges(t, block, func(r []string) (iptrie.Range, string) {
 		if len(r) < 6 {
-			continue
+			return iptrie.Range{}, ShortRow
+		}
+		s, e, reason := parseRange(r[0], r[1])
+		if reason != "" {
+			return iptrie.Range{}, reason
 		}
-		a = &AS{
+		a := &AS{
 			Dsc: r[5],
 		}
-		a.Num, _ = strconv.ParseInt(r[4], 10, 64)
-		t.AddRange(r[0], r[1], a)
-	}
-	return nil
+		var err error
+		a.Num, err = strconv.ParseInt(r[4], 10, 64)
+		if err != nil {
+			return iptrie.Range{}, BadASN
+		}
+		return ipRange(s, e, a), ""
+	})
 }
 
-// AddMaxmindIPv4ASN reads CSV information from the maxmind IPv4 ASN block
-// file and adds the appropriate ranges to the IPTrie.
-func AddMaxmindIPv4ASN(t *iptrie.IPTrie, block io.Reader) error {
-	c := csv.NewReader(block)
-	c.FieldsPerRecord = -1
-	c.TrailingComma = true
-	var a *AS
-	var r []string
-	var s int64
-	var e int64
-	var err error
-	for {
-		r, err = c.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+// AddMaxmindIPv4ASN is like the package level function of the same name but
+// reports bad rows through the Loader.
+func (l *Loader) AddMaxmindIPv4ASN(t *iptrie.IPTrie, block io.Reader) error {
+	return l.readRanges(t, block, func(r []string) (iptrie.Range, string) {
+		if len(r) < 3 {
+			return iptrie.Range{}, ShortRow
 		}
-		if len(r) < 4 {
-			continue
+		s, e, reason := parseRangeNum(r[0], r[1])
+		if reason != "" {
+			return iptrie.Range{}, reason
 		}
-		a = &AS{
-			Dsc: r[3],
+		if len(r) == 3 {
+			a, reason := parseASName(r[2])
+			if reason != "" {
+				return iptrie.Range{}, reason
+			}
+			return ipRange(s, e, a), ""
 		}
-		a.Num, _ = strconv.ParseInt(r[2], 10, 64)
-		s, err = strconv.ParseInt(r[0], 10, 64)
-		if err != nil {
-			continue
+		a := &AS{
+			Dsc: r[3],
 		}
-		e, err = strconv.ParseInt(r[1], 10, 64)
+		var err error
+		a.Num, err = strconv.ParseInt(r[2], 10, 64)
 		if err != nil {
-			continue
+			return iptrie.Range{}, BadASN
 		}
-		t.AddRangeNum(uint32(s), uint32(e), a)
+		return ipRange(s, e, a), ""
+	})
+}
+
+// parseASName splits a column such as "AS15169 Google Inc." into the AS
+// number and description.
+func parseASName(f string) (*AS, string) {
+	if !strings.HasPrefix(f, "AS") {
+		return nil, BadASN
+	}
+	n, d := f[2:], ""
+	if i := strings.IndexByte(n, ' '); i >= 0 {
+		n, d = n[:i], n[i+1:]
 	}
-	return nil
+	num, err := strconv.ParseInt(n, 10, 64)
+	if err != nil {
+		return nil, BadASN
+	}
+	return &AS{Num: num, Dsc: d}, ""
 }
 
-// AddMaxmindIPv6City reads CSV information from the maxmind IPv6 city block
-// file and adds the appropriate ranges to the IPTrie.
-func AddMaxmindIPv6City(t *iptrie.IPTrie, block io.Reader) error {
-	c := csv.NewReader(block)
-	c.FieldsPerRecord = -1
-	c.TrailingComma = true
-	var loc *Loc
-	var r []string
-	var err error
-	for {
-		r, err = c.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
+// AddMaxmindIPv6City is like the package level function of the same name but
+// reports bad rows through the Loader.
+func (l *Loader) AddMaxmindIPv6City(t *iptrie.IPTrie, block io.Reader) error {
+	return l.readRanges(t, block, func(r []string) (iptrie.Range, string) {
 		if len(r) < 9 {
-			continue
+			return iptrie.Range{}, ShortRow
+		}
+		s, e, reason := parseRange(r[0], r[1])
+		if reason != "" {
+			return iptrie.Range{}, reason
 		}
-		loc = &Loc{
+		loc := &Loc{
 			CountryCode: r[4],
 			Region:      r[5],
 		}
-		loc.Lat, _ = strconv.ParseFloat(r[7], 64)
-		loc.Lon, _ = strconv.ParseFloat(r[8], 64)
-		t.AddRange(r[0], r[1], loc)
-	}
-	return nil
+		if reason = parseLatLon(loc, r[7], r[8]); reason != "" {
+			return iptrie.Range{}, reason
+		}
+		return ipRange(s, e, loc), ""
+	})
 }
 
-// AddMaxmindIPv4City reads CSV information from the maxmind IPv6 city block
-// and location file and adds the appropriate ranges to the IPTrie.
-func AddMaxmindIPv4City(t *iptrie.IPTrie, block, location io.Reader) error {
-	c := csv.NewReader(location)
-	c.FieldsPerRecord = -1
-	c.TrailingComma = true
+// AddMaxmindIPv4City is like the package level function of the same name but
+// reports bad rows through the Loader.
+func (l *Loader) AddMaxmindIPv4City(t *iptrie.IPTrie, block, location io.Reader) error {
 	lm := make(map[string]*Loc)
-	var r []string
-	var err error
-	for {
-		r, err = c.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
+	err := l.read("location", location, func(r []string) string {
 		if len(r) < 7 {
-			continue
+			return ShortRow
 		}
-		lm[r[0]] = &Loc{
+		loc := &Loc{
 			CountryCode: r[1],
 			Region:      r[2],
 			City:        r[3],
 		}
-
-		lm[r[0]].Lat, _ = strconv.ParseFloat(r[5], 64)
-		lm[r[0]].Lon, _ = strconv.ParseFloat(r[6], 64)
-	}
-	c = csv.NewReader(block)
-	c.FieldsPerRecord = -1
-	c.TrailingComma = true
-	var loc *Loc
-	var s int64
-	var e int64
-	for {
-		r, err = c.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+		if reason := parseLatLon(loc, r[5], r[6]); reason != "" {
+			return reason
 		}
+		lm[r[0]] = loc
+		l.Report.Locations++
+		return ""
+	})
+	if err != nil {
+		return err
+	}
+	return l.readRanges(t, block, func(r []string) (iptrie.Range, string) {
 		if len(r) < 3 {
-			continue
+			return iptrie.Range{}, ShortRow
 		}
-		loc = lm[r[2]]
+		loc := lm[r[2]]
 		if loc == nil {
-			continue
-		}
-		s, err = strconv.ParseInt(r[0], 10, 64)
-		if err != nil {
-			continue
+			return iptrie.Range{}, UnknownLocation
 		}
-		e, err = strconv.ParseInt(r[1], 10, 64)
-		if err != nil {
-			continue
+		s, e, reason := parseRangeNum(r[0], r[1])
+		if reason != "" {
+			return iptrie.Range{}, reason
 		}
-		t.AddRangeNum(uint32(s), uint32(e), loc)
-	}
-	return nil
+		return ipRange(s, e, loc), ""
+	})
 }
 
-// AddMaxmindIPv4City reads CSV information from the maxmind IPv6 country
-// block and location file and adds the appropriate ranges to the IPTrie.
-// Don't add this data with the city data, but instead use it in a separate
-// iptrie.IPTrie to fill in nil results.
-func AddMaxmindIPv4Country(t *iptrie.IPTrie, block, location io.Reader) error {
-	c := csv.NewReader(location)
-	c.FieldsPerRecord = -1
-	c.TrailingComma = true
+// AddMaxmindIPv4Country is like the package level function of the same name
+// but reports bad rows through the Loader.
+func (l *Loader) AddMaxmindIPv4Country(t *iptrie.IPTrie, block, location io.Reader) error {
 	lm := make(map[string]*Loc)
-	var r []string
-	var err error
-	for {
-		r, err = c.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
+	err := l.read("location", location, func(r []string) string {
 		if len(r) < 4 {
-			continue
+			return ShortRow
 		}
-		lm[r[0]] = &Loc{
+		loc := &Loc{
 			CountryCode: r[0],
 		}
-
-		lm[r[0]].Lat, _ = strconv.ParseFloat(r[1], 64)
-		lm[r[0]].Lon, _ = strconv.ParseFloat(r[2], 64)
-	}
-	c = csv.NewReader(block)
-	c.FieldsPerRecord = -1
-	c.TrailingComma = true
-	var loc *Loc
-	for {
-		r, err = c.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+		if reason := parseLatLon(loc, r[1], r[2]); reason != "" {
+			return reason
 		}
+		lm[r[0]] = loc
+		l.Report.Locations++
+		return ""
+	})
+	if err != nil {
+		return err
+	}
+	return l.readRanges(t, block, func(r []string) (iptrie.Range, string) {
 		if len(r) < 5 {
-			continue
+			return iptrie.Range{}, ShortRow
 		}
-		loc = lm[r[4]]
+		loc := lm[r[4]]
 		if loc == nil {
-			continue
+			return iptrie.Range{}, UnknownLocation
+		}
+		s, e, reason := parseRange(r[0], r[1])
+		if reason != "" {
+			return iptrie.Range{}, reason
 		}
-		t.AddRange(r[0], r[1], loc)
+		return ipRange(s, e, loc), ""
+	})
+}
+
+// parseRange parses the start and end of a range given as IP addresses.
+func parseRange(sAddr, eAddr string) (net.IP, net.IP, string) {
+	s := net.ParseIP(sAddr)
+	if s == nil {
+		return nil, nil, BadStart
+	}
+	e := net.ParseIP(eAddr)
+	if e == nil {
+		return nil, nil, BadEnd
+	}
+	return s, e, ""
+}
+
+// parseRangeNum parses the start and end of a range given as uint32s.
+func parseRangeNum(sAddr, eAddr string) (net.IP, net.IP, string) {
+	s, err := strconv.ParseUint(sAddr, 10, 32)
+	if err != nil {
+		return nil, nil, BadStart
+	}
+	e, err := strconv.ParseUint(eAddr, 10, 32)
+	if err != nil {
+		return nil, nil, BadEnd
+	}
+	return iptrie.Uint32ToIPv4(uint32(s)), iptrie.Uint32ToIPv4(uint32(e)), ""
+}
+
+func parseLatLon(loc *Loc, lat, lon string) string {
+	var err error
+	loc.Lat, err = strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return BadLat
+	}
+	loc.Lon, err = strconv.ParseFloat(lon, 64)
+	if err != nil {
+		return BadLon
 	}
-	return nil
+	return ""
 }
@@ -7,6 +7,8 @@ package geo
 import (
 	"bytes"
 	"testing"
+
+	"code.google.com/p/iptrie"
 )
 
 const blocks = `"3232235521","3232238335","A"
@@ -20,7 +22,7 @@ const location = `"A","A","A","A","",-27.9864,26.7066,,
 func TestMaxmindIPv4(t *testing.T) {
 	fBlock := bytes.NewBufferString(blocks)
 	fLocation := bytes.NewBufferString(location)
-	ipt := NewIPTrie()
+	ipt := iptrie.NewIPTrie()
 	err := AddMaxmindIPv4City(ipt, fBlock, fLocation)
 	if err != nil {
 		t.Fatalf("TestMaxmindIPv4:AddMaxmindIPv4City: %v", err)
@@ -57,3 +59,36 @@ func TestMaxmindIPv4(t *testing.T) {
 		t.Errorf("%s Loc = %v\n", s, i)
 	}
 }
+
+func TestMaxmindIPv4ASN(t *testing.T) {
+	in := `134744064,134744319,"AS15169 Google Inc."
+1137311744,1137312767,577,"Bell Canada"
+16777216,16777471,"AS2519"
+33554432,33554687,"Unknown"`
+	ipt := iptrie.NewIPTrie()
+	l := new(Loader)
+	if err := l.AddMaxmindIPv4ASN(ipt, bytes.NewBufferString(in)); err != nil {
+		t.Fatalf("AddMaxmindIPv4ASN: %v", err)
+	}
+	var asnTests = []struct {
+		ip  string
+		num int64
+		dsc string
+	}{
+		{"8.8.8.8", 15169, "Google Inc."},
+		{"67.202.1.1", 577, "Bell Canada"},
+		{"1.0.0.1", 2519, ""},
+	}
+	for _, tt := range asnTests {
+		a, _ := ipt.Get(tt.ip).(*AS)
+		if a == nil || a.Num != tt.num || a.Dsc != tt.dsc {
+			t.Errorf("Get(%s) = %v, want AS%d %q", tt.ip, a, tt.num, tt.dsc)
+		}
+	}
+	if ipt.Get("2.0.0.1") != nil {
+		t.Errorf("Get(2.0.0.1) = %v for a row without an AS number", ipt.Get("2.0.0.1"))
+	}
+	if r := l.Report; r.Reasons[BadASN] != 1 {
+		t.Errorf("Report = %+v, want one %q", r, BadASN)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"errors"
+	"math"
+)
+
+// The WGS-84 ellipsoid, in meters.
+const (
+	wgs84A = 6378137
+	wgs84F = 1 / 298.257223563
+	wgs84B = wgs84A * (1 - wgs84F)
+)
+
+var ErrNoConvergence = errors.New("geo: Vincenty formula did not converge")
+
+// A Unit is a unit of distance, measured in km.  Distances in this package are
+// in km; Unit converts them.
+type Unit float64
+
+const (
+	Kilometers    Unit = 1
+	Miles         Unit = 1.609344
+	NauticalMiles Unit = 1.852
+)
+
+// From converts a distance in km to the unit.
+func (u Unit) From(km float64) float64 {
+	return km / float64(u)
+}
+
+// To converts a distance in the unit to km.
+func (u Unit) To(d float64) float64 {
+	return d * float64(u)
+}
+
+func rad2Deg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// normBearing maps an angle in degrees to [0, 360).
+func normBearing(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg
+}
+
+// normLon maps a longitude in degrees to [-180, 180).
+func normLon(deg float64) float64 {
+	return normBearing(deg+180) - 180
+}
+
+// Vincenty computes the distance in km between two geolocations on the WGS-84
+// ellipsoid, and the initial and final bearings in degrees clockwise from
+// north, with the inverse formula of Vincenty.  It is accurate to within a
+// millimeter but ErrNoConvergence is returned for nearly antipodal points.
+// The bearings are 0 if the points are equal.
+func Vincenty(lat1, lon1, lat2, lon2 float64) (dist, initial, final float64, err error) {
+
+	l := deg2Rad(lon2 - lon1)
+	u1 := math.Atan((1 - wgs84F) * math.Tan(deg2Rad(lat1)))
+	u2 := math.Atan((1 - wgs84F) * math.Tan(deg2Rad(lat2)))
+	sinU1, cosU1 := math.Sincos(u1)
+	sinU2, cosU2 := math.Sincos(u2)
+
+	lambda := l
+	var sinSigma, cosSigma, sigma, cosSqAlpha, cos2SigmaM, sinLambda, cosLambda float64
+	for i := 0; ; i++ {
+		if i == 200 {
+			return 0, 0, 0, ErrNoConvergence
+		}
+		sinLambda, cosLambda = math.Sincos(lambda)
+		sinSigma = math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			return 0, 0, 0, nil // coincident points
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cosSqAlpha != 0 { // both points on the equator otherwise
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		c := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+		prev := lambda
+		lambda = l + (1-c)*wgs84F*sinAlpha*
+			(sigma+c*sinSigma*(cos2SigmaM+c*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-prev) < 1e-12 {
+			break
+		}
+		if math.Abs(lambda) > math.Pi {
+			return 0, 0, 0, ErrNoConvergence
+		}
+	}
+
+	uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	a := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	b := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	deltaSigma := b * sinSigma * (cos2SigmaM + b/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+		b/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+	dist = wgs84B * a * (sigma - deltaSigma) / 1000
+
+	initial = rad2Deg(math.Atan2(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda))
+	final = rad2Deg(math.Atan2(cosU1*sinLambda, -sinU1*cosU2+cosU1*sinU2*cosLambda))
+	return dist, normBearing(initial), normBearing(final), nil
+}
+
+// VincentyDestination computes the geolocation reached from a geolocation by
+// following a bearing in degrees for a distance in km on the WGS-84
+// ellipsoid, and the final bearing, with the direct formula of Vincenty.
+func VincentyDestination(lat, lon, bearing, dist float64) (lat2, lon2, final float64) {
+
+	sinAlpha1, cosAlpha1 := math.Sincos(deg2Rad(bearing))
+	tanU1 := (1 - wgs84F) * math.Tan(deg2Rad(lat))
+	cosU1 := 1 / math.Sqrt(1+tanU1*tanU1)
+	sinU1 := tanU1 * cosU1
+	sigma1 := math.Atan2(tanU1, cosAlpha1)
+	sinAlpha := cosU1 * sinAlpha1
+	cosSqAlpha := 1 - sinAlpha*sinAlpha
+	uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	a := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	b := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+
+	s := dist * 1000
+	sigma := s / (wgs84B * a)
+	var sinSigma, cosSigma, cos2SigmaM float64
+	for i := 0; i < 200; i++ {
+		cos2SigmaM = math.Cos(2*sigma1 + sigma)
+		sinSigma, cosSigma = math.Sincos(sigma)
+		deltaSigma := b * sinSigma * (cos2SigmaM + b/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+			b/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+		prev := sigma
+		sigma = s/(wgs84B*a) + deltaSigma
+		if math.Abs(sigma-prev) < 1e-12 {
+			break
+		}
+	}
+	sinSigma, cosSigma = math.Sincos(sigma)
+	cos2SigmaM = math.Cos(2*sigma1 + sigma)
+
+	x := sinU1*sinSigma - cosU1*cosSigma*cosAlpha1
+	phi2 := math.Atan2(sinU1*cosSigma+cosU1*sinSigma*cosAlpha1, (1-wgs84F)*math.Hypot(sinAlpha, x))
+	lambda := math.Atan2(sinSigma*sinAlpha1, cosU1*cosSigma-sinU1*sinSigma*cosAlpha1)
+	c := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+	l := lambda - (1-c)*wgs84F*sinAlpha*
+		(sigma+c*sinSigma*(cos2SigmaM+c*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
+	final = rad2Deg(math.Atan2(sinAlpha, -x))
+	return rad2Deg(phi2), normLon(lon + rad2Deg(l)), normBearing(final)
+}
+
+// InitialBearing computes the bearing in degrees clockwise from north at the
+// start of the great circle path between two geolocations.
+func InitialBearing(lat1, lon1, lat2, lon2 float64) float64 {
+
+	phi1, phi2 := deg2Rad(lat1), deg2Rad(lat2)
+	dlon := deg2Rad(lon2 - lon1)
+	y := math.Sin(dlon) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dlon)
+	return normBearing(rad2Deg(math.Atan2(y, x)))
+}
+
+// FinalBearing computes the bearing in degrees clockwise from north at the
+// end of the great circle path between two geolocations.
+func FinalBearing(lat1, lon1, lat2, lon2 float64) float64 {
+	return normBearing(InitialBearing(lat2, lon2, lat1, lon1) + 180)
+}
+
+// Destination computes the geolocation reached from a geolocation by
+// following a great circle with an initial bearing in degrees for a distance
+// in km.
+func Destination(lat, lon, bearing, dist float64) (float64, float64) {
+
+	phi1, theta := deg2Rad(lat), deg2Rad(bearing)
+	delta := dist / EarthRadius
+	sinPhi2 := math.Sin(phi1)*math.Cos(delta) + math.Cos(phi1)*math.Sin(delta)*math.Cos(theta)
+	phi2 := math.Asin(sinPhi2)
+	y := math.Sin(theta) * math.Sin(delta) * math.Cos(phi1)
+	x := math.Cos(delta) - math.Sin(phi1)*sinPhi2
+	return rad2Deg(phi2), normLon(lon + rad2Deg(math.Atan2(y, x)))
+}
+
+// Midpoint computes the geolocation halfway along the great circle path
+// between two geolocations.
+func Midpoint(lat1, lon1, lat2, lon2 float64) (float64, float64) {
+
+	phi1, phi2 := deg2Rad(lat1), deg2Rad(lat2)
+	dlon := deg2Rad(lon2 - lon1)
+	bx := math.Cos(phi2) * math.Cos(dlon)
+	by := math.Cos(phi2) * math.Sin(dlon)
+	phi3 := math.Atan2(math.Sin(phi1)+math.Sin(phi2), math.Hypot(math.Cos(phi1)+bx, by))
+	lon3 := deg2Rad(lon1) + math.Atan2(by, math.Cos(phi1)+bx)
+	return rad2Deg(phi3), normLon(rad2Deg(lon3))
+}
+
+// BoundingBox computes the smallest latitude and longitude box holding every
+// geolocation within a distance in km of a geolocation.  If the box crosses
+// the 180th meridian minLon is greater than maxLon.  If it holds a pole the
+// box spans all longitudes.
+func BoundingBox(lat, lon, dist float64) (minLat, minLon, maxLat, maxLon float64) {
+
+	delta := rad2Deg(dist / EarthRadius)
+	minLat, maxLat = lat-delta, lat+delta
+	if minLat <= -90 || maxLat >= 90 || delta >= 180 {
+		return math.Max(minLat, -90), -180, math.Min(maxLat, 90), 180
+	}
+	// The widest point of the circle is where a meridian touches it, which
+	// is not at the latitude of the center.
+	dlon := rad2Deg(math.Asin(math.Sin(deg2Rad(delta)) / math.Cos(deg2Rad(lat))))
+	return minLat, normLon(lon - dlon), maxLat, normLon(lon + dlon)
+}
@@ -0,0 +1,152 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func dms(d, m, s float64) float64 {
+	if d < 0 {
+		return d - m/60 - s/3600
+	}
+	return d + m/60 + s/3600
+}
+
+// Flinders Peak and Buninyong, the example of Vincenty (1975) as computed
+// on WGS-84 by Geoscience Australia.
+var (
+	flindersLat  = dms(-37, 57, 3.72030)
+	flindersLon  = dms(144, 25, 29.52440)
+	buninyongLat = dms(-37, 39, 10.15610)
+	buninyongLon = dms(143, 55, 35.38390)
+)
+
+func TestVincenty(t *testing.T) {
+	var tests = []struct {
+		lat1, lon1, lat2, lon2 float64
+		dist, initial, final   float64
+	}{
+		{flindersLat, flindersLon, buninyongLat, buninyongLon, 54.972271, dms(306, 52, 5.37), dms(307, 10, 25.07)},
+		{0, 0, 0, 1, 111.319491, 90, 90},
+		{90, 0, 0, 0, 10001.965729, 180, 180},
+		{10, 20, 10, 20, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		dist, initial, final, err := Vincenty(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		if err != nil {
+			t.Errorf("Vincenty(%v, %v, %v, %v): %v", tt.lat1, tt.lon1, tt.lat2, tt.lon2, err)
+			continue
+		}
+		if math.Abs(dist-tt.dist) > 1e-6 {
+			t.Errorf("Vincenty(%v, %v, %v, %v) distance = %.6f, want %.6f", tt.lat1, tt.lon1, tt.lat2, tt.lon2, dist, tt.dist)
+		}
+		if math.Abs(initial-tt.initial) > 1e-5 || math.Abs(final-tt.final) > 1e-5 {
+			t.Errorf("Vincenty(%v, %v, %v, %v) bearings = %.6f, %.6f, want %.6f, %.6f", tt.lat1, tt.lon1, tt.lat2, tt.lon2, initial, final, tt.initial, tt.final)
+		}
+	}
+	if _, _, _, err := Vincenty(0, 0, 0.5, 179.7); err != ErrNoConvergence {
+		t.Errorf("Vincenty of nearly antipodal points: err = %v", err)
+	}
+}
+
+func TestVincentyDestination(t *testing.T) {
+	lat, lon, final := VincentyDestination(flindersLat, flindersLon, dms(306, 52, 5.37), 54.972271)
+	if math.Abs(lat-buninyongLat) > 1e-7 || math.Abs(lon-buninyongLon) > 1e-7 {
+		t.Errorf("VincentyDestination = %.8f, %.8f, want %.8f, %.8f", lat, lon, buninyongLat, buninyongLon)
+	}
+	if math.Abs(final-dms(307, 10, 25.07)) > 1e-5 {
+		t.Errorf("VincentyDestination final bearing = %.6f", final)
+	}
+}
+
+func TestBearing(t *testing.T) {
+	// Baghdad to Osaka starts on a heading of about 60 degrees and ends on
+	// one of about 120 degrees.
+	initial, final := InitialBearing(35, 45, 35, 135), FinalBearing(35, 45, 35, 135)
+	if math.Abs(initial-60) > 0.2 || math.Abs(initial+final-180) > 1e-9 {
+		t.Errorf("Baghdad to Osaka bearings = %v, %v", initial, final)
+	}
+	_, vi, vf, _ := Vincenty(35, 45, 35, 135)
+	if math.Abs(vi-initial) > 0.2 || math.Abs(vf-final) > 0.2 {
+		t.Errorf("Vincenty bearings %v, %v differ from %v, %v", vi, vf, initial, final)
+	}
+	if b := InitialBearing(0, 10, 0, 0); b != 270 {
+		t.Errorf("InitialBearing due west = %v", b)
+	}
+}
+
+func TestDestination(t *testing.T) {
+	var tests = []struct {
+		lat1, lon1, lat2, lon2 float64
+	}{
+		{35, 45, 35, 135},
+		{-33.9, 151.2, 51.5, -0.1},
+		{10, 179, -10, -179},
+	}
+	for _, tt := range tests {
+		d := Distance(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		lat, lon := Destination(tt.lat1, tt.lon1, InitialBearing(tt.lat1, tt.lon1, tt.lat2, tt.lon2), d)
+		if Distance(lat, lon, tt.lat2, tt.lon2) > 1e-6 {
+			t.Errorf("Destination toward %v, %v = %v, %v", tt.lat2, tt.lon2, lat, lon)
+		}
+
+		lat, lon = Midpoint(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+		d1, d2 := Distance(tt.lat1, tt.lon1, lat, lon), Distance(lat, lon, tt.lat2, tt.lon2)
+		if math.Abs(d1-d/2) > 1e-6 || math.Abs(d2-d/2) > 1e-6 {
+			t.Errorf("Midpoint(%v) = %v, %v at %v and %v km, want %v", tt, lat, lon, d1, d2, d/2)
+		}
+	}
+	if lat, lon := Destination(0, 0, 90, EarthRadius*math.Pi/2); math.Abs(lat) > 1e-9 || math.Abs(lon-90) > 1e-9 {
+		t.Errorf("Destination a quarter around the equator = %v, %v", lat, lon)
+	}
+}
+
+func TestBoundingBox(t *testing.T) {
+	var tests = []struct {
+		lat, lon, dist float64
+	}{
+		{0, 0, 100},
+		{60, 20, 500},
+		{-45, 179.5, 300},
+		{85, 0, 1000},
+	}
+	for _, tt := range tests {
+		minLat, minLon, maxLat, maxLon := BoundingBox(tt.lat, tt.lon, tt.dist)
+		for b := 0.0; b < 360; b += 5 {
+			lat, lon := Destination(tt.lat, tt.lon, b, tt.dist*0.999)
+			inLon := lon >= minLon && lon <= maxLon
+			if minLon > maxLon {
+				inLon = lon >= minLon || lon <= maxLon
+			}
+			if lat < minLat || lat > maxLat || !inLon {
+				t.Errorf("BoundingBox(%v) = %v, %v, %v, %v misses %v, %v", tt, minLat, minLon, maxLat, maxLon, lat, lon)
+			}
+		}
+	}
+	minLat, minLon, maxLat, maxLon := BoundingBox(0, 0, 111.19492664455873)
+	if math.Abs(minLat+1) > 1e-9 || math.Abs(maxLat-1) > 1e-9 || math.Abs(minLon+1) > 1e-9 || math.Abs(maxLon-1) > 1e-9 {
+		t.Errorf("BoundingBox of 1 degree at the equator = %v, %v, %v, %v", minLat, minLon, maxLat, maxLon)
+	}
+	if _, minLon, _, maxLon := BoundingBox(-45, 179.5, 300); minLon < maxLon {
+		t.Errorf("BoundingBox across the 180th meridian = %v, %v", minLon, maxLon)
+	}
+}
+
+func TestUnit(t *testing.T) {
+	if m := Miles.From(1.609344); m != 1 {
+		t.Errorf("Miles.From = %v", m)
+	}
+	if nm := NauticalMiles.From(Distance(0, 0, 1.0/60, 0)); math.Abs(nm-1.0006) > 1e-3 {
+		t.Errorf("a minute of latitude is %v nautical miles", nm)
+	}
+	if km := Miles.To(Miles.From(42)); math.Abs(km-42) > 1e-12 {
+		t.Errorf("Miles round trip = %v", km)
+	}
+	if km := Kilometers.From(7); km != 7 {
+		t.Errorf("Kilometers.From = %v", km)
+	}
+}
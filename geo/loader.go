@@ -0,0 +1,272 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"code.google.com/p/iptrie"
+)
+
+// maxReportRows limits the number of skipped rows kept in a Report.  Rows
+// beyond the limit are still counted.
+const maxReportRows = 100
+
+// batchLines is the number of lines of a block file parsed and added to the
+// IPTrie at a time by a concurrent Loader.
+const batchLines = 4096
+
+// Reasons a row is skipped by a Loader.
+const (
+	ShortRow        = "short row"
+	BadStart        = "bad start address"
+	BadEnd          = "bad end address"
+	BadASN          = "bad AS number"
+	BadLat          = "bad latitude"
+	BadLon          = "bad longitude"
+	UnknownLocation = "unknown location id"
+)
+
+// A Loader reads maxmind CSV data into an IPTrie.  The zero value is a lenient
+// loader that skips rows it can not use, which is what the package level
+// AddMaxmind functions do.  A strict loader fails on the first bad row.  Either
+// way the Report records what was loaded and what was skipped.  A Loader may be
+// used for several files, the Report accumulates across calls.
+//
+// When Workers is greater than one block files are parsed on that many
+// goroutines and the ranges are added to the IPTrie in batches.  Block files
+// must then have one row per line, which is true for all maxmind files.
+type Loader struct {
+	Strict  bool   // fail on the first bad row
+	Header  int    // leading lines of every file to ignore, e.g. copyright and column names
+	Workers int    // goroutines parsing block files
+	Report  Report // summary of the rows read so far
+}
+
+// A Report summarizes the rows read by a Loader.
+type Report struct {
+	Loaded    int            // ranges added to the IPTrie
+	Locations int            // locations read from location files
+	Skipped   int            // rows that were not used
+	Reasons   map[string]int // skipped rows by reason
+	Rows      []*RowError    // the first skipped rows
+}
+
+// A RowError describes a row that could not be loaded.
+type RowError struct {
+	File   string // "block" or "location"
+	Line   int    // line number in the file, starting at 1
+	Reason string
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("geo: %s line %d: %s", e.File, e.Line, e.Reason)
+}
+
+func newCSVReader(in io.Reader) *csv.Reader {
+	c := csv.NewReader(in)
+	c.FieldsPerRecord = -1
+	c.TrailingComma = true
+	return c
+}
+
+// read calls fn for every row of a CSV file after the header.  fn returns the
+// reason the row could not be used or "" if it was used.
+func (l *Loader) read(file string, in io.Reader, fn func(r []string) string) error {
+	c := newCSVReader(in)
+	for {
+		r, err := c.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line, _ := c.FieldPos(0)
+		if line <= l.Header {
+			continue
+		}
+		if reason := fn(r); reason != "" {
+			if err = l.skip(file, line, reason); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// skip records a row that could not be used.  In strict mode the row is also
+// returned as an error.
+func (l *Loader) skip(file string, line int, reason string) error {
+	e := &RowError{
+		File:   file,
+		Line:   line,
+		Reason: reason,
+	}
+	rp := &l.Report
+	rp.Skipped++
+	if rp.Reasons == nil {
+		rp.Reasons = make(map[string]int)
+	}
+	rp.Reasons[reason]++
+	if len(rp.Rows) < maxReportRows {
+		rp.Rows = append(rp.Rows, e)
+	}
+	if l.Strict {
+		return e
+	}
+	return nil
+}
+
+// readRanges adds the range parsed from every row of a block file to the
+// IPTrie.  parse returns the reason a row could not be used or "" if it was.
+// It must be safe to call parse from several goroutines.
+func (l *Loader) readRanges(t *iptrie.IPTrie, in io.Reader, parse func(r []string) (iptrie.Range, string)) error {
+	if l.Workers <= 1 {
+		return l.read("block", in, func(r []string) string {
+			rg, reason := parse(r)
+			if reason == "" {
+				t.AddRangeIp(rg.Start, rg.End, rg.Data)
+				l.Report.Loaded++
+			}
+			return reason
+		})
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	batches := make(chan *batch)
+	results := make(chan *batch)
+	go func() {
+		defer close(batches)
+		l.split(in, batches, done)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < l.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				b.parse(l.Header, parse)
+				select {
+				case results <- b:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Batches are applied in the order they were read so that the report and
+	// strict mode behave as they do for a single goroutine.
+	pending := make(map[int]*batch)
+	next := 0
+	for b := range results {
+		pending[b.seq] = b
+		for b = pending[next]; b != nil; b = pending[next] {
+			delete(pending, next)
+			next++
+			if b.err != nil {
+				return b.err
+			}
+			for _, e := range b.skips {
+				if err := l.skip("block", e.Line, e.Reason); err != nil {
+					return err
+				}
+			}
+			t.AddRanges(b.ranges)
+			l.Report.Loaded += len(b.ranges)
+		}
+	}
+	return nil
+}
+
+// A batch is a group of lines from a block file and the ranges parsed from it.
+type batch struct {
+	seq    int    // position of the batch in the file
+	line   int    // line number of the first line
+	data   []byte // the lines
+	err    error
+	ranges []iptrie.Range
+	skips  []RowError
+}
+
+// split cuts a block file into batches of lines.
+func (l *Loader) split(in io.Reader, batches chan<- *batch, done <-chan struct{}) {
+	s := bufio.NewScanner(in)
+	b := &batch{line: 1}
+	n := 0
+	send := func() bool {
+		select {
+		case batches <- b:
+		case <-done:
+			return false
+		}
+		b = &batch{seq: b.seq + 1, line: b.line + n}
+		n = 0
+		return true
+	}
+	for s.Scan() {
+		b.data = append(b.data, s.Bytes()...)
+		b.data = append(b.data, '\n')
+		n++
+		if n == batchLines && !send() {
+			return
+		}
+	}
+	b.err = s.Err()
+	if n > 0 || b.err != nil {
+		send()
+	}
+}
+
+func (b *batch) parse(header int, parse func(r []string) (iptrie.Range, string)) {
+	if b.err != nil {
+		return
+	}
+	c := newCSVReader(bytes.NewReader(b.data))
+	for {
+		r, err := c.Read()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if pe, ok := err.(*csv.ParseError); ok {
+				pe.StartLine += b.line - 1
+				pe.Line += b.line - 1
+			}
+			b.err = err
+			return
+		}
+		line, _ := c.FieldPos(0)
+		line += b.line - 1
+		if line <= header {
+			continue
+		}
+		rg, reason := parse(r)
+		if reason != "" {
+			b.skips = append(b.skips, RowError{"block", line, reason})
+			continue
+		}
+		b.ranges = append(b.ranges, rg)
+	}
+}
+
+// ipRange converts the start and end of a range to their 16-byte
+// representation.
+func ipRange(s, e net.IP, data interface{}) iptrie.Range {
+	return iptrie.Range{
+		Start: s.To16(),
+		End:   e.To16(),
+		Data:  data,
+	}
+}
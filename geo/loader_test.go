@@ -0,0 +1,145 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"code.google.com/p/iptrie"
+)
+
+const badBlocks = `Copyright (c) 2013 MaxMind LLC.  All Rights Reserved.
+startIpNum,endIpNum,locId
+"3232235521","3232238335","A"
+"3232253185","3232301055","D"
+"3232301313","x","C"
+"3232369408"`
+
+const badLocation = `Copyright (c) 2013 MaxMind LLC.  All Rights Reserved.
+locId,country,region,city,postalCode,latitude,longitude,metroCode,areaCode
+"A","A","A","A","",-27.9864,26.7066,,
+"B","B","B","B","",,31.0447,,
+"C","C","C","C","",-22.5700,17.0836,,`
+
+func TestLoaderLenient(t *testing.T) {
+	l := &Loader{Header: 2}
+	ipt := iptrie.NewIPTrie()
+	err := l.AddMaxmindIPv4City(ipt, bytes.NewBufferString(badBlocks), bytes.NewBufferString(badLocation))
+	if err != nil {
+		t.Fatalf("AddMaxmindIPv4City: %v", err)
+	}
+	rp := l.Report
+	if rp.Loaded != 1 || rp.Locations != 2 || rp.Skipped != 4 {
+		t.Errorf("Report = %d loaded, %d locations, %d skipped", rp.Loaded, rp.Locations, rp.Skipped)
+	}
+	want := []RowError{
+		{"location", 4, BadLat},
+		{"block", 4, UnknownLocation},
+		{"block", 5, BadEnd},
+		{"block", 6, ShortRow},
+	}
+	if len(rp.Rows) != len(want) {
+		t.Fatalf("Report.Rows = %v", rp.Rows)
+	}
+	for i := range want {
+		if *rp.Rows[i] != want[i] {
+			t.Errorf("Report.Rows[%d] = %v, want %v", i, *rp.Rows[i], want[i])
+		}
+	}
+	if rp.Reasons[ShortRow] != 1 {
+		t.Errorf("Report.Reasons = %v", rp.Reasons)
+	}
+	if ipt.Get("192.168.8.8") == nil {
+		t.Errorf("192.168.8.8 not loaded")
+	}
+}
+
+func TestLoaderStrict(t *testing.T) {
+	l := &Loader{Strict: true, Header: 2}
+	ipt := iptrie.NewIPTrie()
+	err := l.AddMaxmindIPv4City(ipt, bytes.NewBufferString(blocks), bytes.NewBufferString(badLocation))
+	e, ok := err.(*RowError)
+	if !ok {
+		t.Fatalf("AddMaxmindIPv4City = %v, want *RowError", err)
+	}
+	if e.File != "location" || e.Line != 4 || e.Reason != BadLat {
+		t.Errorf("AddMaxmindIPv4City = %v", e)
+	}
+
+	l = &Loader{Strict: true}
+	err = l.AddMaxmindIPv4City(ipt, bytes.NewBufferString(blocks), bytes.NewBufferString(location))
+	if err != nil {
+		t.Errorf("AddMaxmindIPv4City: %v", err)
+	}
+	if l.Report.Loaded != 3 || l.Report.Skipped != 0 {
+		t.Errorf("Report = %+v", l.Report)
+	}
+}
+
+// genBlocks returns n consecutive /24 ranges cycling through the locations in
+// the test location file, with a bad row at line bad if bad is positive.
+func genBlocks(n, bad int) string {
+	var b bytes.Buffer
+	s := uint32(3232235521)
+	for i := 1; i <= n; i++ {
+		if i == bad {
+			b.WriteString("\"x\",\"0\",\"A\"\n")
+			continue
+		}
+		fmt.Fprintf(&b, "\"%d\",\"%d\",\"%c\"\n", s, s+253, 'A'+i%3)
+		s += 256
+	}
+	return b.String()
+}
+
+func TestLoaderWorkers(t *testing.T) {
+	data := genBlocks(3*batchLines+17, 0)
+	l1 := &Loader{}
+	t1 := iptrie.NewIPTrie()
+	if err := l1.AddMaxmindIPv4City(t1, bytes.NewBufferString(data), bytes.NewBufferString(location)); err != nil {
+		t.Fatal(err)
+	}
+	l4 := &Loader{Workers: 4}
+	t4 := iptrie.NewIPTrie()
+	if err := l4.AddMaxmindIPv4City(t4, bytes.NewBufferString(data), bytes.NewBufferString(location)); err != nil {
+		t.Fatal(err)
+	}
+	if l1.Report.Loaded != l4.Report.Loaded || l4.Report.Loaded != 3*batchLines+17 {
+		t.Errorf("Loaded = %d and %d", l1.Report.Loaded, l4.Report.Loaded)
+	}
+	for i := 0; i < 1000; i++ {
+		ip := iptrie.Uint32ToIPv4(3232235521 + uint32(i*97)).String()
+		c1, _ := t1.Get(ip).(*Loc)
+		c4, _ := t4.Get(ip).(*Loc)
+		if (c1 == nil) != (c4 == nil) || c1 != nil && *c1 != *c4 {
+			t.Errorf("Get(%s) = %v, want %v", ip, c4, c1)
+		}
+	}
+
+	bad := 2*batchLines + 5
+	l := &Loader{Strict: true, Workers: 4}
+	err := l.AddMaxmindIPv4City(iptrie.NewIPTrie(), bytes.NewBufferString(genBlocks(3*batchLines, bad)), bytes.NewBufferString(location))
+	if e, ok := err.(*RowError); !ok || e.Line != bad || e.Reason != BadStart {
+		t.Errorf("AddMaxmindIPv4City = %v, want line %d", err, bad)
+	}
+}
+
+func benchmarkLoader(b *testing.B, workers int) {
+	data := genBlocks(b.N, 0)
+	l := &Loader{Workers: workers}
+	b.ResetTimer()
+	l.AddMaxmindIPv4City(iptrie.NewIPTrie(), bytes.NewBufferString(data), bytes.NewBufferString(location))
+}
+
+func BenchmarkLoader(b *testing.B) {
+	benchmarkLoader(b, 1)
+}
+
+func BenchmarkLoaderWorkers(b *testing.B) {
+	benchmarkLoader(b, runtime.NumCPU())
+}
@@ -0,0 +1,264 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/iptrie"
+)
+
+// A Reloader keeps an IPTrie up to date.  A new IPTrie is built in the
+// background by Load, checked against MinEntries and Samples, and only then
+// replaces the current one.  Lookups never see a partially loaded IPTrie and
+// keep using the old one if a reload fails.
+type Reloader struct {
+	Load       func() (*iptrie.IPTrie, error)
+	MinEntries int                           // ranges a new IPTrie must have
+	Samples    []string                      // addresses a new IPTrie must have data for
+	OnReload   func(t *iptrie.IPTrie, n int) // called after a new IPTrie with n ranges is published
+	OnError    func(err error)               // called when a reload fails
+
+	reloader
+}
+
+// reloader holds what Reloader and DBReloader share: the published value and
+// the goroutines started by Every and Watch.
+type reloader struct {
+	v      atomic.Value
+	mu     sync.Mutex // serializes reloads
+	stopMu sync.Mutex // protects stop
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewReloader creates a Reloader that builds new tries with load.  Nothing is
+// loaded until Reload is called or a trigger fires.
+func NewReloader(load func() (*iptrie.IPTrie, error)) *Reloader {
+	return &Reloader{Load: load}
+}
+
+// NewFileReloader creates a Reloader that builds new tries by passing the
+// named file to add, for example AddMaxmindIPv4ASN.
+func NewFileReloader(name string, add func(t *iptrie.IPTrie, r io.Reader) error) *Reloader {
+	return NewReloader(func() (*iptrie.IPTrie, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		t := iptrie.NewIPTrie()
+		if err = add(t, f); err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
+// Trie returns the current IPTrie or nil if nothing was loaded yet.
+func (r *Reloader) Trie() *iptrie.IPTrie {
+	t, _ := r.v.Load().(*iptrie.IPTrie)
+	return t
+}
+
+// Get looks up addr in the current IPTrie.
+func (r *Reloader) Get(addr string) interface{} {
+	t := r.Trie()
+	if t == nil {
+		return nil
+	}
+	return t.Get(addr)
+}
+
+// Reload builds, checks and publishes a new IPTrie.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, n, err := r.build()
+	if err != nil {
+		if r.OnError != nil {
+			r.OnError(err)
+		}
+		return err
+	}
+	r.v.Store(t)
+	if r.OnReload != nil {
+		r.OnReload(t, n)
+	}
+	return nil
+}
+
+func (r *Reloader) build() (*iptrie.IPTrie, int, error) {
+	t, err := r.Load()
+	if err != nil {
+		return nil, 0, err
+	}
+	n := 0
+	t.Walk(func(iptrie.Range) bool {
+		n++
+		return true
+	})
+	if n < r.MinEntries {
+		return nil, n, fmt.Errorf("geo: reload: %d ranges, want at least %d", n, r.MinEntries)
+	}
+	for _, s := range r.Samples {
+		if t.Get(s) == nil {
+			return nil, n, fmt.Errorf("geo: reload: no data for %s", s)
+		}
+	}
+	return t, n, nil
+}
+
+// Every reloads the IPTrie every d until Stop is called.
+func (r *Reloader) Every(d time.Duration) {
+	r.poll(d, always, r.Reload)
+}
+
+// Watch checks every d whether the named file, or any file in the named
+// directory, was modified and reloads the IPTrie if it was.  Watch stops when
+// Stop is called.
+func (r *Reloader) Watch(name string, d time.Duration) {
+	r.poll(d, modified(name), r.Reload)
+}
+
+func always() bool {
+	return true
+}
+
+// modified returns a function reporting whether the named file or directory
+// changed since the previous call.
+func modified(name string) func() bool {
+	last := modTime(name)
+	return func() bool {
+		m := modTime(name)
+		if m.Equal(last) {
+			return false
+		}
+		last = m
+		return true
+	}
+}
+
+func (r *reloader) poll(d time.Duration, changed func() bool, reload func() error) {
+	r.stopMu.Lock()
+	if r.stop == nil {
+		r.stop = make(chan struct{})
+	}
+	stop := r.stop
+	r.wg.Add(1)
+	r.stopMu.Unlock()
+	go func() {
+		defer r.wg.Done()
+		tk := time.NewTicker(d)
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+				if changed() {
+					reload()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends Every and Watch and waits for a running reload to finish.  It may
+// be called more than once and on a Reloader that was never started.
+func (r *reloader) Stop() {
+	r.stopMu.Lock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.stopMu.Unlock()
+	r.wg.Wait()
+}
+
+// A DBReloader keeps a DB up to date the way a Reloader keeps an IPTrie.  A
+// new DB is checked against Samples before it replaces the current one.
+type DBReloader struct {
+	Load     func() (*DB, error)
+	Samples  []string        // addresses a new DB must find
+	OnReload func(db *DB)    // called after a new DB is published
+	OnError  func(err error) // called when a reload fails
+
+	reloader
+}
+
+// NewDBReloader creates a DBReloader that builds new DBs with load.  Nothing
+// is loaded until Reload is called or a trigger fires.
+func NewDBReloader(load func() (*DB, error)) *DBReloader {
+	return &DBReloader{Load: load}
+}
+
+// DB returns the current DB or nil if nothing was loaded yet.
+func (r *DBReloader) DB() *DB {
+	db, _ := r.v.Load().(*DB)
+	return db
+}
+
+// Reload builds, checks and publishes a new DB.
+func (r *DBReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	db, err := r.build()
+	if err != nil {
+		if r.OnError != nil {
+			r.OnError(err)
+		}
+		return err
+	}
+	r.v.Store(db)
+	if r.OnReload != nil {
+		r.OnReload(db)
+	}
+	return nil
+}
+
+func (r *DBReloader) build() (*DB, error) {
+	db, err := r.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range r.Samples {
+		if _, err = db.Lookup(s); err != nil {
+			return nil, fmt.Errorf("geo: reload: %s: %v", s, err)
+		}
+	}
+	return db, nil
+}
+
+// Every reloads the DB every d until Stop is called.
+func (r *DBReloader) Every(d time.Duration) {
+	r.poll(d, always, r.Reload)
+}
+
+// Watch checks every d whether the named file, or any file in the named
+// directory, was modified and reloads the DB if it was.  Watch stops when
+// Stop is called.
+func (r *DBReloader) Watch(name string, d time.Duration) {
+	r.poll(d, modified(name), r.Reload)
+}
+
+// modTime returns the latest modification time of a file or of the files in a
+// directory.
+func modTime(name string) time.Time {
+	var m time.Time
+	filepath.Walk(name, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.ModTime().After(m) {
+			m = fi.ModTime()
+		}
+		return nil
+	})
+	return m
+}
@@ -0,0 +1,198 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.google.com/p/iptrie"
+)
+
+func TestReloader(t *testing.T) {
+	n := 0
+	data := blocks
+	r := NewReloader(func() (*iptrie.IPTrie, error) {
+		n++
+		if n == 3 {
+			return nil, errors.New("load failed")
+		}
+		t := iptrie.NewIPTrie()
+		err := AddMaxmindIPv4City(t, bytes.NewBufferString(data), bytes.NewBufferString(location))
+		return t, err
+	})
+	r.MinEntries = 3
+	r.Samples = []string{"192.168.8.8"}
+	var reloads, errs int
+	r.OnReload = func(t *iptrie.IPTrie, n int) {
+		reloads++
+	}
+	r.OnError = func(err error) {
+		errs++
+	}
+
+	if r.Get("192.168.8.8") != nil {
+		t.Errorf("Get before Reload")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	first := r.Trie()
+	if r.Get("192.168.8.8") == nil {
+		t.Errorf("Get after Reload")
+	}
+
+	// too few entries
+	data = `"3232235521","3232238335","A"`
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload: expected MinEntries error")
+	}
+	// failing loader
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload: expected load error")
+	}
+	// missing sample
+	r.MinEntries = 1
+	r.Samples = []string{"192.168.80.10"}
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload: expected sample error")
+	}
+	if r.Trie() != first {
+		t.Errorf("Trie replaced by a failed reload")
+	}
+	if reloads != 1 || errs != 3 {
+		t.Errorf("OnReload called %d times, OnError %d times", reloads, errs)
+	}
+}
+
+func TestReloaderConcurrent(t *testing.T) {
+	r := NewReloader(func() (*iptrie.IPTrie, error) {
+		t := iptrie.NewIPTrie()
+		err := AddMaxmindIPv4City(t, bytes.NewBufferString(blocks), bytes.NewBufferString(location))
+		return t, err
+	})
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if r.Get("192.168.8.8") == nil {
+					t.Errorf("Get returned nil during reload")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		r.Reload()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestReloaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "GeoIPASNum2.csv")
+	if err = ioutil.WriteFile(name, []byte("134744064,134744319,15169,\"Google Inc.\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewFileReloader(name, AddMaxmindIPv4ASN)
+	if err = r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	reloaded := make(chan int, 1)
+	r.OnReload = func(t *iptrie.IPTrie, n int) {
+		reloaded <- n
+	}
+	r.Watch(name, 10*time.Millisecond)
+	defer r.Stop()
+
+	err = ioutil.WriteFile(name, []byte("134744064,134744319,15169,\"Google Inc.\"\n1137311744,1137312767,577,\"Bell Canada\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(name, future, future)
+	select {
+	case n := <-reloaded:
+		if n != 2 {
+			t.Errorf("OnReload: %d ranges, want 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Watch: file change not noticed")
+	}
+	if a, _ := r.Get("67.202.1.1").(*AS); a == nil || a.Num != 577 {
+		t.Errorf("Get = %v after reload", a)
+	}
+}
+
+func TestReloaderStop(t *testing.T) {
+	var n int32
+	r := &Reloader{Load: func() (*iptrie.IPTrie, error) {
+		atomic.AddInt32(&n, 1)
+		return iptrie.NewIPTrie(), nil
+	}}
+	r.Stop()
+	r.Every(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	r.Stop()
+	r.Stop()
+	m := atomic.LoadInt32(&n)
+	if m == 0 {
+		t.Errorf("Every: no reload")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&n) != m {
+		t.Errorf("Every: reloads after Stop")
+	}
+}
+
+func TestDBReloader(t *testing.T) {
+	fail := false
+	r := NewDBReloader(func() (*DB, error) {
+		if fail {
+			return NewDB(), nil
+		}
+		return OpenDB("testdata/db")
+	})
+	r.Samples = []string{"8.8.8.8"}
+	if r.DB() != nil {
+		t.Fatalf("DB before Reload = %v", r.DB())
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	db := r.DB()
+	fail = true
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload of an empty DB: expected error")
+	}
+	if r.DB() != db {
+		t.Errorf("failed Reload replaced the DB")
+	}
+	r.Stop()
+}
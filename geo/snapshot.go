@@ -0,0 +1,177 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+
+	"code.google.com/p/iptrie"
+)
+
+// snapshotMagic starts every snapshot, followed by the format version.
+const (
+	snapshotMagic   = "GEOS"
+	snapshotVersion = 1
+)
+
+var ErrBadSnapshot = errors.New("geo: not a snapshot or unsupported version")
+
+// Kinds of data stored in a snapshot range.
+const (
+	snapLoc = iota
+	snapAS
+	snapRoute
+)
+
+// A snapshot holds the ranges of a DB.  The data of the ranges is stored once
+// in the tables and referenced by index, since many ranges share a location.
+type snapshot struct {
+	Locs    []Loc
+	ASes    []AS
+	Routes  []Route
+	City    []snapRange
+	Country []snapRange
+	ASN     []snapRange
+}
+
+type snapRange struct {
+	Start []byte // 4 bytes for IPv4 addresses, 16 otherwise
+	End   []byte
+	Kind  uint8
+	Index int32
+}
+
+// WriteSnapshot writes the tries of a DB to w in a compact binary form that
+// ReadSnapshot can load much faster than the CSV files.
+func WriteSnapshot(w io.Writer, db *DB) error {
+	s := &snapshot{}
+	locs := make(map[*Loc]int32)
+	ases := make(map[*AS]int32)
+	routes := make(map[*Route]int32)
+	encode := func(t *iptrie.IPTrie) []snapRange {
+		var rs []snapRange
+		if t == nil {
+			return rs
+		}
+		t.Walk(func(r iptrie.Range) bool {
+			sr := snapRange{
+				Start: compactIP(r.Start),
+				End:   compactIP(r.End),
+			}
+			switch d := r.Data.(type) {
+			case *Loc:
+				i, ok := locs[d]
+				if !ok {
+					i = int32(len(s.Locs))
+					locs[d] = i
+					s.Locs = append(s.Locs, *d)
+				}
+				sr.Kind, sr.Index = snapLoc, i
+			case *AS:
+				i, ok := ases[d]
+				if !ok {
+					i = int32(len(s.ASes))
+					ases[d] = i
+					s.ASes = append(s.ASes, *d)
+				}
+				sr.Kind, sr.Index = snapAS, i
+			case *Route:
+				i, ok := routes[d]
+				if !ok {
+					i = int32(len(s.Routes))
+					routes[d] = i
+					s.Routes = append(s.Routes, *d)
+				}
+				sr.Kind, sr.Index = snapRoute, i
+			default:
+				return true
+			}
+			rs = append(rs, sr)
+			return true
+		})
+		return rs
+	}
+	s.City = encode(db.City)
+	s.Country = encode(db.Country)
+	s.ASN = encode(db.ASN)
+
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{snapshotVersion}); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(s)
+}
+
+// ReadSnapshot reads a DB written by WriteSnapshot.
+func ReadSnapshot(r io.Reader) (*DB, error) {
+	h := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, ErrBadSnapshot
+	}
+	if !bytes.Equal(h[:len(snapshotMagic)], []byte(snapshotMagic)) || h[len(snapshotMagic)] != snapshotVersion {
+		return nil, ErrBadSnapshot
+	}
+	s := &snapshot{}
+	if err := gob.NewDecoder(r).Decode(s); err != nil {
+		return nil, err
+	}
+
+	data := func(sr snapRange) interface{} {
+		i := int(sr.Index)
+		switch {
+		case i < 0:
+		case sr.Kind == snapLoc && i < len(s.Locs):
+			return &s.Locs[i]
+		case sr.Kind == snapAS && i < len(s.ASes):
+			return &s.ASes[i]
+		case sr.Kind == snapRoute && i < len(s.Routes):
+			return &s.Routes[i]
+		}
+		return nil
+	}
+	decode := func(srs []snapRange) (*iptrie.IPTrie, error) {
+		rs := make([]iptrie.Range, len(srs))
+		for i, sr := range srs {
+			d := data(sr)
+			if d == nil {
+				return nil, ErrBadSnapshot
+			}
+			rs[i] = iptrie.Range{
+				Start: net.IP(sr.Start).To16(),
+				End:   net.IP(sr.End).To16(),
+				Data:  d,
+			}
+			if rs[i].Start == nil || rs[i].End == nil {
+				return nil, ErrBadSnapshot
+			}
+		}
+		return iptrie.BuildIPTrie(rs)
+	}
+	db := &DB{}
+	var err error
+	if db.City, err = decode(s.City); err != nil {
+		return nil, err
+	}
+	if db.Country, err = decode(s.Country); err != nil {
+		return nil, err
+	}
+	if db.ASN, err = decode(s.ASN); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func compactIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
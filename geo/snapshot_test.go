@@ -0,0 +1,47 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	db, err := OpenDB("testdata/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("testdata/bgpdump.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = AddBGPDumpASN(db.ASN, f); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err = WriteSnapshot(&b, db); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	sdb, err := ReadSnapshot(&b)
+	if err != nil {
+		t.Fatalf("ReadSnapshot: %v", err)
+	}
+	for _, ip := range []string{"8.8.8.8", "1.0.0.1", "9.1.2.3", "67.202.1.1", "10.1.2.3", "10.9.9.9", "2001:4860::1", "127.0.0.1"} {
+		r1, err1 := db.Lookup(ip)
+		r2, err2 := sdb.Lookup(ip)
+		if err1 != err2 || !reflect.DeepEqual(r1, r2) {
+			t.Errorf("Lookup(%s) = %+v %v, want %+v %v", ip, r2, err2, r1, err1)
+		}
+	}
+
+	if _, err = ReadSnapshot(bytes.NewBufferString("GEOS\x09")); err != ErrBadSnapshot {
+		t.Errorf("ReadSnapshot = %v, want ErrBadSnapshot", err)
+	}
+}
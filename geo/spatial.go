@@ -0,0 +1,139 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"math"
+	"sort"
+
+	"code.google.com/p/iptrie"
+)
+
+// A Point is a geolocation in degrees.
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+// A LocIndex answers spatial queries over the ranges of an IPTrie whose data
+// is a *Loc.  The locations are kept in a grid of 1 degree cells so that a
+// query only looks at the locations in the cells it covers.  The index does
+// not follow later changes to the IPTrie.
+type LocIndex struct {
+	ranges []iptrie.Range   // in address order
+	locs   []*Loc           // distinct locations
+	byLoc  [][]int          // location --> indexes of its ranges
+	cells  map[[2]int][]int // cell --> indexes of its locations
+}
+
+// NewLocIndex indexes the ranges of the IPTrie that have a *Loc.
+func NewLocIndex(t *iptrie.IPTrie) *LocIndex {
+	x := &LocIndex{
+		cells: make(map[[2]int][]int),
+	}
+	index := make(map[Loc]int)
+	t.Walk(func(r iptrie.Range) bool {
+		loc, ok := r.Data.(*Loc)
+		if !ok || loc == nil {
+			return true
+		}
+		i, ok := index[*loc]
+		if !ok {
+			i = len(x.locs)
+			index[*loc] = i
+			x.locs = append(x.locs, loc)
+			x.byLoc = append(x.byLoc, nil)
+			c := locCell(loc.Lat, loc.Lon)
+			x.cells[c] = append(x.cells[c], i)
+		}
+		x.byLoc[i] = append(x.byLoc[i], len(x.ranges))
+		x.ranges = append(x.ranges, r)
+		return true
+	})
+	return x
+}
+
+func locCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+// Len returns the number of indexed ranges.
+func (x *LocIndex) Len() int {
+	return len(x.ranges)
+}
+
+// Within returns the ranges located within a distance in km of a geolocation,
+// in address order.
+func (x *LocIndex) Within(lat, lon, dist float64) []iptrie.Range {
+	minLat, minLon, maxLat, maxLon := BoundingBox(lat, lon, dist)
+	return x.query(minLat, minLon, maxLat, maxLon, func(l *Loc) bool {
+		return Distance(lat, lon, l.Lat, l.Lon) <= dist
+	})
+}
+
+// InPolygon returns the ranges located inside a polygon, in address order.
+// The edges of the polygon are straight lines in latitude and longitude and
+// it must not cross the 180th meridian.  Locations on an edge may or may not
+// be inside.
+func (x *LocIndex) InPolygon(poly []Point) []iptrie.Range {
+	if len(poly) < 3 {
+		return nil
+	}
+	minLat, minLon := math.Inf(1), math.Inf(1)
+	maxLat, maxLon := math.Inf(-1), math.Inf(-1)
+	for _, p := range poly {
+		minLat, maxLat = math.Min(minLat, p.Lat), math.Max(maxLat, p.Lat)
+		minLon, maxLon = math.Min(minLon, p.Lon), math.Max(maxLon, p.Lon)
+	}
+	return x.query(minLat, minLon, maxLat, maxLon, func(l *Loc) bool {
+		return inPolygon(poly, l.Lat, l.Lon)
+	})
+}
+
+// inPolygon counts the edges a ray from the point toward larger longitudes
+// crosses.
+func inPolygon(poly []Point, lat, lon float64) bool {
+	in := false
+	j := len(poly) - 1
+	for i, p := range poly {
+		q := poly[j]
+		if (p.Lat > lat) != (q.Lat > lat) &&
+			lon < (q.Lon-p.Lon)*(lat-p.Lat)/(q.Lat-p.Lat)+p.Lon {
+			in = !in
+		}
+		j = i
+	}
+	return in
+}
+
+// query returns the ranges of the locations in the box for which match is
+// true.  The box crosses the 180th meridian if minLon is greater than maxLon.
+func (x *LocIndex) query(minLat, minLon, maxLat, maxLon float64, match func(*Loc) bool) []iptrie.Range {
+	var found []int
+	visit := func(lo, hi float64) {
+		c0, c1 := locCell(minLat, lo), locCell(maxLat, hi)
+		for i := c0[0]; i <= c1[0]; i++ {
+			for j := c0[1]; j <= c1[1]; j++ {
+				for _, l := range x.cells[[2]int{i, j}] {
+					if match(x.locs[l]) {
+						found = append(found, x.byLoc[l]...)
+					}
+				}
+			}
+		}
+	}
+	if minLon > maxLon {
+		visit(minLon, 180)
+		visit(-180, maxLon)
+	} else {
+		visit(minLon, maxLon)
+	}
+	sort.Ints(found)
+	rs := make([]iptrie.Range, len(found))
+	for i, r := range found {
+		rs[i] = x.ranges[r]
+	}
+	return rs
+}
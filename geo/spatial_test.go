@@ -0,0 +1,130 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package geo
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"code.google.com/p/iptrie"
+)
+
+func rangeStarts(rs []iptrie.Range) string {
+	s := ""
+	for _, r := range rs {
+		s += r.Start.String() + " "
+	}
+	return s
+}
+
+func TestLocIndexDB(t *testing.T) {
+	db, err := OpenDB("testdata/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewLocIndex(db.City)
+	if x.Len() == 0 {
+		t.Fatal("no ranges indexed")
+	}
+
+	// Mountain View is about 51 km from San Francisco.  The IPv6 ranges have
+	// the same location but no city.
+	rs := x.Within(37.7749, -122.4194, 60)
+	if len(rs) == 0 {
+		t.Fatal("Within(San Francisco, 60) found nothing")
+	}
+	for _, r := range rs {
+		if l := r.Data.(*Loc); l.CountryCode != "US" || l.Region != "CA" {
+			t.Errorf("Within(San Francisco, 60) found %v", l)
+		}
+	}
+	if rs := x.Within(37.7749, -122.4194, 10); len(rs) != 0 {
+		t.Errorf("Within(San Francisco, 10) = %v", rangeStarts(rs))
+	}
+
+	// A box around Ontario.
+	ontario := []Point{{42, -95}, {57, -95}, {57, -74}, {42, -74}}
+	rs = x.InPolygon(ontario)
+	if len(rs) == 0 {
+		t.Fatal("InPolygon(Ontario) found nothing")
+	}
+	for _, r := range rs {
+		if l := r.Data.(*Loc); l.City != "Toronto" || l.Region != "ON" {
+			t.Errorf("InPolygon(Ontario) found %v", l)
+		}
+	}
+	if rs := x.InPolygon(ontario[:2]); rs != nil {
+		t.Errorf("InPolygon of two points = %v", rangeStarts(rs))
+	}
+}
+
+func TestLocIndexRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tr := iptrie.NewIPTrie()
+	var locs []*Loc
+	for i := 0; i < 50; i++ {
+		locs = append(locs, &Loc{City: fmt.Sprint(i), Lat: r.Float64()*170 - 85, Lon: r.Float64()*360 - 180})
+	}
+	var all []iptrie.Range
+	for i := uint32(0); i < 500; i++ {
+		s := i<<16 + 1
+		tr.AddRangeNum(s, s+100, locs[r.Intn(len(locs))])
+	}
+	tr.Walk(func(r iptrie.Range) bool {
+		all = append(all, r)
+		return true
+	})
+	x := NewLocIndex(tr)
+	if x.Len() != len(all) {
+		t.Fatalf("Len = %d, want %d", x.Len(), len(all))
+	}
+
+	for i := 0; i < 50; i++ {
+		lat, lon, dist := r.Float64()*180-90, r.Float64()*360-180, r.Float64()*5000
+		want := ""
+		for _, rr := range all {
+			l := rr.Data.(*Loc)
+			if Distance(lat, lon, l.Lat, l.Lon) <= dist {
+				want += rr.Start.String() + " "
+			}
+		}
+		if got := rangeStarts(x.Within(lat, lon, dist)); got != want {
+			t.Fatalf("Within(%v, %v, %v) = %v, want %v", lat, lon, dist, got, want)
+		}
+	}
+
+	// A triangle with a hole in its bounding box.
+	tri := []Point{{-60, -120}, {60, -120}, {0, 120}}
+	want := ""
+	for _, rr := range all {
+		l := rr.Data.(*Loc)
+		if inPolygon(tri, l.Lat, l.Lon) {
+			want += rr.Start.String() + " "
+		}
+	}
+	if got := rangeStarts(x.InPolygon(tri)); got != want {
+		t.Errorf("InPolygon(triangle) = %v, want %v", got, want)
+	}
+}
+
+func TestLocIndexAntimeridian(t *testing.T) {
+	tr := iptrie.NewIPTrie()
+	tr.AddRangeIp(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.9"), &Loc{City: "east", Lat: 0, Lon: 179.9})
+	tr.AddRangeIp(net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.9"), &Loc{City: "west", Lat: 0, Lon: -179.9})
+	tr.AddRangeIp(net.ParseIP("10.0.2.1"), net.ParseIP("10.0.2.9"), &Loc{City: "far", Lat: 0, Lon: 170})
+	tr.Add("10.0.3.0", "not a location")
+	x := NewLocIndex(tr)
+	if x.Len() != 3 {
+		t.Errorf("Len = %d, want 3", x.Len())
+	}
+	if got := rangeStarts(x.Within(0, 180, 50)); got != "10.0.0.1 10.0.1.1 " {
+		t.Errorf("Within across the 180th meridian = %v", got)
+	}
+	if got := rangeStarts(x.InPolygon([]Point{{-1, 169}, {1, 169}, {1, 171}, {-1, 171}})); got != "10.0.2.1 " {
+		t.Errorf("InPolygon = %v", got)
+	}
+}
@@ -5,110 +5,205 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strconv"
+
+	"code.google.com/p/iptrie"
 )
 
-func uint32ToBytes(n uint32) []byte {
-	t := n
-	a := make([]byte, 4)
-	a[3] = byte(t & 0x000000FF)
-	t = t >> 8
-	a[2] = byte(t & 0x000000FF)
-	t = t >> 8
-	a[1] = byte(t & 0x000000FF)
-	t = t >> 8
-	a[0] = byte(t & 0x000000FF)
-	return a
+// A CompressSummary reports what CompressRangeLocation read and wrote.
+type CompressSummary struct {
+	Read    int // ranges read
+	Written int // ranges written after merging adjacent ranges
+}
+
+// parseAddr parses an address given as an uint32, as maxmind does for IPv4,
+// or in the usual text form.  num reports which one it was.
+func parseAddr(s string) (ip net.IP, num bool) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return iptrie.Uint32ToIPv4(uint32(n)), true
+	}
+	return net.ParseIP(s).To16(), false
+}
+
+func formatAddr(ip net.IP, num bool) string {
+	if num {
+		return strconv.FormatUint(uint64(iptrie.IPv4ToUInt32(ip)), 10)
+	}
+	return ip.String()
 }
 
-// CompressRangeLocation compresses the file obtained from updateMaxMindRange
-// and generates a binary and ascii file.
-func CompressRangeLocation() error {
-
-	filenamer := "maxmind_range_ipv4_location.csv"
-	filenamew1 := "maxmind_range_ipv4_location_compressed.csv"
-	filenamew2 := "maxmind_range_ipv4_location_compressed.bin"
-	f1, errr := os.Open(filenamer)
-	f2, errw2 := os.Create(filenamew1)
-	f3, errw3 := os.Create(filenamew2)
-	defer f1.Close()
-	defer f2.Close()
-	defer f3.Close()
-	if errr != nil {
-		panic(errr)
-	}
-	if errw2 != nil {
-		panic(errw2)
-	}
-	if errw3 != nil {
-		panic(errw3)
-	}
-
-	r := csv.NewReader(f1)
-	var record, recordNext []string
-	var start, end, locId, startNext, endNext, locIdNext uint32
-	var num uint64
-	record, errr = r.Read()
-	if errr == io.EOF || len(record) == 0 {
-		err := fmt.Errorf("File is empty/First line cannot be blank\n")
-		return err
-	}
-
-	num, _ = strconv.ParseUint(record[0], 10, 32)
-	start = uint32(num)
-	num, _ = strconv.ParseUint(record[1], 10, 32)
-	end = uint32(num)
-	num, _ = strconv.ParseUint(record[2], 10, 32)
-	locId = uint32(num)
+// parseRecord parses a start,end,cell row of a range location file.
+func parseRecord(record []string, line int) (RangeRecord, bool, error) {
+	var r RangeRecord
+	if len(record) < 3 {
+		return r, false, fmt.Errorf("line %d is too short", line)
+	}
+	var num bool
+	if r.Start, num = parseAddr(record[0]); r.Start == nil {
+		return r, false, fmt.Errorf("field 1 at line %d is not valid", line)
+	}
+	if r.End, _ = parseAddr(record[1]); r.End == nil {
+		return r, false, fmt.Errorf("field 2 at line %d is not valid", line)
+	}
+	c, err := strconv.ParseUint(record[2], 10, 32)
+	if err != nil {
+		return r, false, fmt.Errorf("field 3 at line %d is not valid", line)
+	}
+	r.Cell = uint32(c)
+	return r, num, nil
+}
+
+// follows reports whether b starts right after a ends.
+func follows(a, b net.IP) bool {
+	n := make(net.IP, len(a))
+	copy(n, a)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+	return bytes.Equal(n, b)
+}
+
+// CompressRangeLocation merges the adjacent ranges with the same location in
+// the output of UpdateRangeLocation.  The ranges are written as CSV to csvOut
+// and as a range file on the DefaultGrid to binOut, either of which may be
+// nil.
+func CompressRangeLocation(in io.Reader, csvOut, binOut io.Writer) (*CompressSummary, error) {
+	return DefaultGrid.CompressRangeLocation(in, csvOut, binOut)
+}
+
+// CompressRangeLocation is like the package level function of the same name
+// for ranges whose cells are on the grid g.  Start and end addresses may be
+// uint32s or IPv4 or IPv6 addresses in text form.
+func (g Grid) CompressRangeLocation(in io.Reader, csvOut, binOut io.Writer) (*CompressSummary, error) {
+	sum := &CompressSummary{}
+	if err := g.Check(); err != nil {
+		return sum, err
+	}
+	var rs []RangeRecord
+	var werr error
+	write := func(r RangeRecord, num bool) {
+		if csvOut != nil && werr == nil {
+			_, werr = fmt.Fprintf(csvOut, "%s,%s,%d\n", formatAddr(r.Start, num), formatAddr(r.End, num), r.Cell)
+		}
+		rs = append(rs, r)
+		sum.Written++
+	}
 
+	c := csv.NewReader(in)
+	c.FieldsPerRecord = -1
+	var cur RangeRecord
+	var curNum bool
 	for {
-		recordNext, errr = r.Read()
-		if errr == io.EOF {
+		record, err := c.Read()
+		if err == io.EOF {
 			break
+		} else if err != nil {
+			return sum, err
 		}
-		if len(recordNext) == 0 {
+		line, _ := c.FieldPos(0)
+		next, num, err := parseRecord(record, line)
+		if err != nil {
+			return sum, err
+		}
+		sum.Read++
+		if sum.Read == 1 {
+			cur, curNum = next, num
 			continue
 		}
 
-		num, _ = strconv.ParseUint(recordNext[0], 10, 32)
-		startNext = uint32(num)
-		num, _ = strconv.ParseUint(recordNext[1], 10, 32)
-		endNext = uint32(num)
-		num, _ = strconv.ParseUint(recordNext[2], 10, 32)
-		locIdNext = uint32(num)
-
-		if locId != locIdNext || end+1 != startNext {
-			fmt.Fprintf(f2, "%d,%d,%d\n", start, end, locId)
-			f3.Write(uint32ToBytes(start))
-			f3.Write(uint32ToBytes(end))
-			f3.Write(uint32ToBytes(locId))
-			start = startNext
-			end = endNext
-			locId = locIdNext
+		if cur.Cell != next.Cell || !follows(cur.End, next.Start) {
+			write(cur, curNum)
+			cur, curNum = next, num
 		} else {
-			// if lodid == locIdNext and end+1 == startNext then compress
-			// don't update start
-			num, _ = strconv.ParseUint(recordNext[1], 10, 32)
-			end = uint32(num)
-			// locIdNext is the same locId
+			// same cell and adjacent, so compress, don't update start
+			cur.End = next.End
+		}
+		if werr != nil {
+			return sum, werr
 		}
 	}
-	// writting the last record in the file
-	fmt.Fprintf(f2, "%d,%d,%d\n", start, end, locId)
-	f3.Write(uint32ToBytes(start))
-	f3.Write(uint32ToBytes(end))
-	f3.Write(uint32ToBytes(locId))
-	bufend := new(bytes.Buffer)
-	errw2 = binary.Write(bufend, binary.LittleEndian, '\n')
-	if errw2 != nil {
-		panic(errw2)
-	}
-	f3.Write(bufend.Bytes())
-	return nil
+	if sum.Read == 0 {
+		return sum, fmt.Errorf("file is empty")
+	}
+	// writing the last record in the file
+	write(cur, curNum)
+	if werr != nil {
+		return sum, werr
+	}
+	if binOut != nil {
+		return sum, WriteRanges(binOut, g, rs)
+	}
+	return sum, nil
+}
+
+// CompressRangeLocationFiles is like CompressRangeLocation but reads and writes
+// the named files.
+func CompressRangeLocationFiles(in, csvOut, binOut string) (*CompressSummary, error) {
+	return DefaultGrid.CompressRangeLocationFiles(in, csvOut, binOut)
+}
+
+// CompressRangeLocationFiles is like the method CompressRangeLocation but
+// reads and writes the named files.
+func (g Grid) CompressRangeLocationFiles(in, csvOut, binOut string) (*CompressSummary, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	wc, err := createFile(csvOut)
+	if err != nil {
+		return nil, err
+	}
+	defer wc.Close()
+	wb, err := createFile(binOut)
+	if err != nil {
+		return nil, err
+	}
+	defer wb.Close()
+	sum, err := g.CompressRangeLocation(f, wc, wb)
+	if err != nil {
+		return sum, err
+	}
+	if err = wc.Close(); err != nil {
+		return sum, err
+	}
+	return sum, wb.Close()
+}
+
+// A bufferedFile is a file written through a bufio.Writer.
+type bufferedFile struct {
+	*bufio.Writer
+	f      *os.File
+	closed bool
+}
+
+func createFile(name string) (*bufferedFile, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedFile{bufio.NewWriter(f), f, false}, nil
+}
+
+// Close flushes and closes the file.  Closing it again does nothing.
+func (b *bufferedFile) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	err := b.Flush()
+	if cerr := b.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
@@ -0,0 +1,88 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"errors"
+	"math"
+)
+
+// A Grid divides the globe into cells of Res degrees of latitude and
+// longitude.  Cell (i, j) holds the latitudes from i*Res-90 and the longitudes
+// from j*Res-180.  Res must divide 180 and leave fewer than 2^32 cells, see
+// Check.
+type Grid struct {
+	Res float64
+}
+
+// DefaultGrid is the 1 degree grid used by UpdateRangeLocation.
+var DefaultGrid = Grid{Res: 1}
+
+var ErrBadGrid = errors.New("util: grid resolution must be positive, divide 180 and give fewer than 2^32 cells")
+
+// Check returns ErrBadGrid if the cells of g cannot be encoded.
+func (g Grid) Check() error {
+	n := math.Round(maxLat / g.Res)
+	if !(g.Res > 0) || n < 1 || math.Abs(n*g.Res-maxLat) > 1e-9 || (n+1)*(2*n+1) > 1<<32 {
+		return ErrBadGrid
+	}
+	return nil
+}
+
+// Rows returns the number of cells from the south to the north pole.
+func (g Grid) Rows() int {
+	return int(math.Round(maxLat/g.Res)) + 1
+}
+
+// Cols returns the number of cells around the globe.
+func (g Grid) Cols() int {
+	return int(math.Round(maxLon/g.Res)) + 1
+}
+
+// Cell returns the cell holding a location.  ok is false if the location is
+// out of range or the grid is not valid.
+func (g Grid) Cell(lat, lon float64) (i, j int, ok bool) {
+	if g.Check() != nil {
+		return 0, 0, false
+	}
+	if lat < -maxLat/2 || lat > maxLat/2 || lon < -maxLon/2 || lon > maxLon/2 {
+		return 0, 0, false
+	}
+	i = g.index(lat + maxLat/2)
+	j = g.index(lon + maxLon/2)
+	if i >= g.Rows() || j >= g.Cols() {
+		return 0, 0, false
+	}
+	return i, j, true
+}
+
+// index returns the number of whole cells in x degrees.  Points on a grid line,
+// such as -89.9 on the 0.1 degree grid, are not exact in floating point and
+// are moved into the cell they start.
+func (g Grid) index(x float64) int {
+	return int(math.Floor(x/g.Res + 1e-9))
+}
+
+// Encode returns the number that represents a cell.  On the 1 degree grid it
+// is i*1000+j, which is easy to read, otherwise i*Cols()+j.
+func (g Grid) Encode(i, j int) uint32 {
+	if g.Res == 1 {
+		return uint32(i*1000 + j)
+	}
+	return uint32(i*g.Cols() + j)
+}
+
+// Decode returns the cell represented by a number.
+func (g Grid) Decode(c uint32) (i, j int) {
+	if g.Res == 1 {
+		return int(c / 1000), int(c % 1000)
+	}
+	return int(c) / g.Cols(), int(c) % g.Cols()
+}
+
+// LatLon returns the south west corner of a cell.
+func (g Grid) LatLon(i, j int) (lat, lon float64) {
+	return float64(i)*g.Res - maxLat/2, float64(j)*g.Res - maxLon/2
+}
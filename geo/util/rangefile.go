@@ -0,0 +1,184 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+
+	"code.google.com/p/iptrie"
+	"code.google.com/p/iptrie/geo"
+)
+
+// A range file holds ranges of IP addresses and the grid cell of their
+// location, as written by CompressRangeLocation.  All numbers are big-endian.
+//
+//	offset  size  field
+//	0       4     magic "IPRL"
+//	4       1     version, 1
+//	5       1     address length, 4 for IPv4 or 16 for IPv6
+//	6       2     reserved, 0
+//	8       8     grid resolution in degrees, IEEE 754 float64
+//	16      8     number of records
+//	24      n     records: start address, end address, uint32 grid cell
+//	24+n    4     CRC-32 (IEEE) of all preceding bytes
+//
+// Files written before the header was introduced hold only IPv4 records on the
+// 1 degree grid followed by a little-endian '\n' rune; they can still be read.
+const (
+	rangeMagic   = "IPRL"
+	rangeVersion = 1
+	headerLen    = 24
+)
+
+var (
+	ErrBadRangeFile = errors.New("util: not a range file or unsupported version")
+	ErrChecksum     = errors.New("util: range file checksum mismatch")
+)
+
+// A RangeRecord is a range of IP addresses and the grid cell of its location.
+type RangeRecord struct {
+	Start net.IP
+	End   net.IP
+	Cell  uint32
+}
+
+// WriteRanges writes a range file.  The records are stored as IPv4 addresses
+// if all of them are IPv4, otherwise as IPv6 addresses.
+func WriteRanges(w io.Writer, g Grid, rs []RangeRecord) error {
+	if err := g.Check(); err != nil {
+		return err
+	}
+	al := net.IPv4len
+	for _, r := range rs {
+		if r.Start.To4() == nil || r.End.To4() == nil {
+			al = net.IPv6len
+			break
+		}
+	}
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	h := make([]byte, headerLen)
+	copy(h, rangeMagic)
+	h[4] = rangeVersion
+	h[5] = byte(al)
+	binary.BigEndian.PutUint64(h[8:], math.Float64bits(g.Res))
+	binary.BigEndian.PutUint64(h[16:], uint64(len(rs)))
+	bw.Write(h)
+	b := make([]byte, 2*al+4)
+	for _, r := range rs {
+		if al == net.IPv4len {
+			copy(b, r.Start.To4())
+			copy(b[al:], r.End.To4())
+		} else {
+			copy(b, r.Start.To16())
+			copy(b[al:], r.End.To16())
+		}
+		binary.BigEndian.PutUint32(b[2*al:], r.Cell)
+		bw.Write(b)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// ReadRanges reads a range file and returns the grid its cells refer to.
+func ReadRanges(r io.Reader) (Grid, []RangeRecord, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Grid{}, nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(rangeMagic)) {
+		return readLegacyRanges(data)
+	}
+	if len(data) < headerLen+4 || data[4] != rangeVersion {
+		return Grid{}, nil, ErrBadRangeFile
+	}
+	al := int(data[5])
+	if al != net.IPv4len && al != net.IPv6len {
+		return Grid{}, nil, ErrBadRangeFile
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(body):]) {
+		return Grid{}, nil, ErrChecksum
+	}
+	g := Grid{math.Float64frombits(binary.BigEndian.Uint64(data[8:]))}
+	if g.Check() != nil {
+		return Grid{}, nil, ErrBadRangeFile
+	}
+	n := binary.BigEndian.Uint64(data[16:])
+	rl := 2*al + 4
+	body = body[headerLen:]
+	if n > uint64(len(body))/uint64(rl) || uint64(len(body)) != n*uint64(rl) {
+		return Grid{}, nil, ErrBadRangeFile
+	}
+	rs := make([]RangeRecord, n)
+	for i := range rs {
+		b := body[i*rl:]
+		rs[i] = RangeRecord{
+			Start: net.IP(b[:al]).To16(),
+			End:   net.IP(b[al : 2*al]).To16(),
+			Cell:  binary.BigEndian.Uint32(b[2*al:]),
+		}
+	}
+	return g, rs, nil
+}
+
+func readLegacyRanges(data []byte) (Grid, []RangeRecord, error) {
+	if len(data)%12 != 4 || binary.LittleEndian.Uint32(data[len(data)-4:]) != '\n' {
+		return Grid{}, nil, ErrBadRangeFile
+	}
+	rs := make([]RangeRecord, len(data)/12)
+	for i := range rs {
+		b := data[i*12:]
+		rs[i] = RangeRecord{
+			Start: iptrie.Uint32ToIPv4(binary.BigEndian.Uint32(b)),
+			End:   iptrie.Uint32ToIPv4(binary.BigEndian.Uint32(b[4:])),
+			Cell:  binary.BigEndian.Uint32(b[8:]),
+		}
+	}
+	return DefaultGrid, rs, nil
+}
+
+// LoadCompressedRanges reads a range file and adds its ranges to the IPTrie.
+// The data of each range is a *geo.Loc holding the center of its grid cell.
+// Nothing is added if the file is damaged or a cell is outside the grid.
+func LoadCompressedRanges(r io.Reader, t *iptrie.IPTrie) error {
+	g, rs, err := ReadRanges(r)
+	if err != nil {
+		return err
+	}
+	locs := make(map[uint32]*geo.Loc)
+	for _, rr := range rs {
+		if i, j := g.Decode(rr.Cell); i >= g.Rows() || j >= g.Cols() {
+			return ErrBadRangeFile
+		}
+	}
+	for _, rr := range rs {
+		loc := locs[rr.Cell]
+		if loc == nil {
+			i, j := g.Decode(rr.Cell)
+			loc = &geo.Loc{}
+			loc.Lat, loc.Lon = g.LatLon(i, j)
+			loc.Lat = math.Min(loc.Lat+g.Res/2, maxLat/2)
+			loc.Lon = math.Min(loc.Lon+g.Res/2, maxLon/2)
+			locs[rr.Cell] = loc
+		}
+		if s, e := rr.Start.To4(), rr.End.To4(); s != nil && e != nil {
+			t.AddRangeNum(iptrie.IPv4ToUInt32(s), iptrie.IPv4ToUInt32(e), loc)
+		} else {
+			t.AddRangeIp(rr.Start, rr.End, loc)
+		}
+	}
+	return nil
+}
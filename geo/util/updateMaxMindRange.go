@@ -12,7 +12,6 @@ import (
 	"io"
 	"os"
 	"strconv"
-	"strings"
 )
 
 const (
@@ -20,155 +19,152 @@ const (
 	maxLon = 360
 )
 
-var (
-	c = [][]string{}
-)
-
-func initc() {
-
-	c = make([][]string, maxLat+1)
-	for i := range c {
-		c[i] = make([]string, maxLon+1)
-		for j := range c[i] {
-			c[i][j] = ""
-		}
-	}
-}
-
-func getCount() {
-
-	count := 0
-	for i := 0; i <= maxLat; i++ {
-		for j := 0; j <= maxLon; j++ {
-			if c[i][j] == "" {
-				continue
-			} else {
-				count++
-			}
-		}
-	}
-	fmt.Printf("There are %d locations\n", count)
+// An UpdateSummary reports what UpdateRangeLocation read and wrote.
+type UpdateSummary struct {
+	Locations int // locations read
+	Cells     int // grid cells holding at least one location
+	Ranges    int // ranges written
 }
 
-func getNewLocationData() error {
-
-	f, err := os.Open("GeoLiteCity-Location.csv")
-	defer f.Close()
-	if err != nil {
-		panic(err)
-	}
-
-	r := csv.NewReader(f)
+// readLocations maps the id of every location to the grid cell holding it.
+// When an id appears more than once the first location is used.
+func (g Grid) readLocations(location io.Reader) (map[string]uint32, error) {
+	r := csv.NewReader(location)
 	r.TrailingComma = true
 	r.FieldsPerRecord = -1
 
-	var record []string
-	var locId string
-	var myLat, myLon int
-	var lat, lon float64
-	n := 0
-
+	index := make(map[string]uint32)
+	data := false
 	for {
-		record, err = r.Read()
+		record, err := r.Read()
 		if err == io.EOF {
 			break
+		} else if err != nil {
+			return index, err
 		}
-		if len(record) == 0 {
+		line, _ := r.FieldPos(0)
+		if len(record) == 0 || !data && isHeader(record) {
 			continue
 		}
+		data = true
+		if len(record) < 7 {
+			return index, fmt.Errorf("location line %d is too short", line)
+		}
 
-		locId = record[0]
-		lat, err = strconv.ParseFloat(record[5], 64)
+		lat, err := strconv.ParseFloat(record[5], 64)
 		if err != nil {
-			err = fmt.Errorf("Latitude at line# %d is not valid \n", n+1)
-			return err
+			return index, fmt.Errorf("latitude at location line %d is not valid", line)
 		}
-		myLat = int(lat + maxLat/2)
-		lon, err = strconv.ParseFloat(record[6], 64)
+		lon, err := strconv.ParseFloat(record[6], 64)
 		if err != nil {
-			err = fmt.Errorf("Longitude at line# %d is not valid \n", n+1)
-			return err
+			return index, fmt.Errorf("longitude at location line %d is not valid", line)
 		}
-		myLon = int(lon + maxLon/2)
-
-		if myLat > maxLat || myLon > maxLon || myLat < 0 || myLon < 0 {
-			err = fmt.Errorf("Geolocation at line# %d is out of range \n", n+1)
-			return err
+		i, j, ok := g.Cell(lat, lon)
+		if !ok {
+			return index, fmt.Errorf("geolocation at location line %d is out of range", line)
+		}
+		if _, ok = index[record[0]]; !ok {
+			index[record[0]] = g.Encode(i, j)
 		}
-		c[myLat][myLon] += locId + ","
-		n++
 	}
-	fmt.Printf("Done reading %d lines\n", n)
-	getCount()
-	return nil
+	return index, nil
+}
+
+// isHeader reports whether a record is a copyright or column name line, which
+// maxmind puts before the data.  Data lines start with a number.
+func isHeader(record []string) bool {
+	_, err := strconv.ParseUint(record[0], 10, 64)
+	return err != nil
 }
 
-// UpdateRangeLocation parses maxMind ranges [start, end]:locationId and updates
-// the locationId of the range to a value that represents its location.
-func UpdateRangeLocation() error {
+// UpdateRangeLocation parses maxMind ranges [start, end]:locationId from the
+// blocks file and writes them to out with the locationId of each range replaced
+// by a value that represents its location, the DefaultGrid cell i*1000+j
+// holding the location, where i is the latitude and j the longitude offset by
+// 90 and 180 degrees.  Copyright and column name lines at the start of either
+// file are skipped.
+func UpdateRangeLocation(location, blocks io.Reader, out io.Writer) (*UpdateSummary, error) {
+	return DefaultGrid.UpdateRangeLocation(location, blocks, out)
+}
 
-	initc()
-	err := getNewLocationData()
-	if err != nil {
-		return err
+// UpdateRangeLocation is like the package level function of the same name but
+// replaces the locationId of each range with the Encode value of the cell of
+// g holding the location.
+func (g Grid) UpdateRangeLocation(location, blocks io.Reader, out io.Writer) (*UpdateSummary, error) {
+	sum := &UpdateSummary{}
+	if err := g.Check(); err != nil {
+		return sum, err
 	}
-	filenamer := "maxmind_city_ipv4_blocks.csv"
-	filenamew := "maxmind_range_ipv4_location.csv"
-	f1, errr := os.Open(filenamer)
-	f2, errw := os.Create(filenamew)
-	defer f1.Close()
-	defer f2.Close()
-	if errr != nil {
-		panic(errr)
+	index, err := g.readLocations(location)
+	if err != nil {
+		return sum, err
 	}
-	if errw != nil {
-		panic(errw)
+	sum.Locations = len(index)
+	cells := make(map[uint32]bool)
+	for _, c := range index {
+		cells[c] = true
 	}
+	sum.Cells = len(cells)
 
-	r := csv.NewReader(f1)
-	var record []string
-	var start, end, locId string
-	var added bool
-	n := 0
+	r := csv.NewReader(blocks)
+	r.FieldsPerRecord = -1
+	data := false
 	for {
-		record, errr = r.Read()
-		if errr == io.EOF {
+		record, err := r.Read()
+		if err == io.EOF {
 			break
+		} else if err != nil {
+			return sum, err
 		}
-		if len(record) == 0 {
+		line, _ := r.FieldPos(0)
+		if len(record) == 0 || !data && isHeader(record) {
 			continue
 		}
+		data = true
+		if len(record) < 3 {
+			return sum, fmt.Errorf("block line %d is too short", line)
+		}
 
-		start = record[0]
-		end = record[1]
-		locId = record[2]
-
-		added = false
-		for i := 0; i <= maxLat && !added; i++ {
-			for j := 0; j <= maxLon && !added; j++ {
-				if c[i][j] == "" {
-					continue
-				} else {
-					split := strings.Split(c[i][j], ",")
-					for _, s := range split {
-						if s == "" {
-							continue
-						}
-						if s == locId {
-							fmt.Fprintf(f2, "%s,%s,%d\n", start, end, i*1000+j)
-							added = true
-							break
-						}
-					}
-				}
-			}
+		start := record[0]
+		end := record[1]
+		c, ok := index[record[2]]
+		if !ok {
+			return sum, fmt.Errorf("range at block line %d not added: %s,%s", line, start, end)
 		}
-		if !added {
-			err = fmt.Errorf("Range at line %d not added: %d,%d", n+1, start, end)
-			return err
+		if _, err = fmt.Fprintf(out, "%s,%s,%d\n", start, end, c); err != nil {
+			return sum, err
 		}
-		n++
+		sum.Ranges++
+	}
+	return sum, nil
+}
+
+// UpdateRangeLocationFiles is like UpdateRangeLocation but reads and writes
+// the named files.
+func UpdateRangeLocationFiles(location, blocks, out string) (*UpdateSummary, error) {
+	return DefaultGrid.UpdateRangeLocationFiles(location, blocks, out)
+}
+
+// UpdateRangeLocationFiles is like the method UpdateRangeLocation but reads
+// and writes the named files.
+func (g Grid) UpdateRangeLocationFiles(location, blocks, out string) (*UpdateSummary, error) {
+	fl, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+	fb, err := os.Open(blocks)
+	if err != nil {
+		return nil, err
+	}
+	defer fb.Close()
+	w, err := createFile(out)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := g.UpdateRangeLocation(fl, fb, w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
 	}
-	fmt.Printf("Done reading %d lines\n", n)
-	return nil
+	return sum, err
 }
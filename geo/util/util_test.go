@@ -0,0 +1,326 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.google.com/p/iptrie"
+	"code.google.com/p/iptrie/geo"
+)
+
+const location = `1,"US","CA","Mountain View","94043",37.4192,-122.0574,807,650
+2,"AU","07","Melbourne","",-37.8139,144.9634,,
+3,"US","CA","Sunnyvale","94086",37.3762,-122.0262,807,408
+`
+
+const blocks = `16777216,16777471,2
+134744064,134744319,1
+134744320,134744575,3
+134744576,134744831,2
+`
+
+func TestUpdateCompress(t *testing.T) {
+	var ranges bytes.Buffer
+	sum, err := UpdateRangeLocation(strings.NewReader(location), strings.NewReader(blocks), &ranges)
+	if err != nil {
+		t.Fatalf("UpdateRangeLocation: %v", err)
+	}
+	if sum.Locations != 3 || sum.Cells != 2 || sum.Ranges != 4 {
+		t.Errorf("UpdateRangeLocation = %+v", *sum)
+	}
+	want := "16777216,16777471,52324\n" +
+		"134744064,134744319,127057\n" +
+		"134744320,134744575,127057\n" +
+		"134744576,134744831,52324\n"
+	if ranges.String() != want {
+		t.Errorf("UpdateRangeLocation wrote %q, want %q", ranges.String(), want)
+	}
+
+	var csvOut, binOut bytes.Buffer
+	csum, err := CompressRangeLocation(&ranges, &csvOut, &binOut)
+	if err != nil {
+		t.Fatalf("CompressRangeLocation: %v", err)
+	}
+	if csum.Read != 4 || csum.Written != 3 {
+		t.Errorf("CompressRangeLocation = %+v", *csum)
+	}
+	want = "16777216,16777471,52324\n" +
+		"134744064,134744575,127057\n" +
+		"134744576,134744831,52324\n"
+	if csvOut.String() != want {
+		t.Errorf("CompressRangeLocation wrote %q, want %q", csvOut.String(), want)
+	}
+	if binOut.Len() != headerLen+3*12+4 {
+		t.Errorf("CompressRangeLocation wrote %d bytes", binOut.Len())
+	}
+}
+
+func TestUpdateMaxmindFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "ranges.csv")
+	sum, err := UpdateRangeLocationFiles("../testdata/db/GeoLiteCity-Location.csv", "../testdata/db/GeoLiteCity-Blocks.csv", out)
+	if err != nil {
+		t.Fatalf("UpdateRangeLocationFiles: %v", err)
+	}
+	if sum.Locations != 3 || sum.Ranges != 3 {
+		t.Errorf("UpdateRangeLocationFiles = %+v", *sum)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "16777216,16777471,52324\n" +
+		"134744064,134744319,127057\n" +
+		"1137311744,1137312767,133100\n"
+	if string(b) != want {
+		t.Errorf("UpdateRangeLocationFiles wrote %q, want %q", b, want)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	var out bytes.Buffer
+	_, err := UpdateRangeLocation(strings.NewReader(location), strings.NewReader("1,2,9\n"), &out)
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("UpdateRangeLocation = %v, want unknown location error", err)
+	}
+	_, err = UpdateRangeLocation(strings.NewReader("1,US,CA,X,,north,0\n"), strings.NewReader(blocks), &out)
+	if err == nil {
+		t.Errorf("UpdateRangeLocation: expected latitude error")
+	}
+	_, err = CompressRangeLocation(strings.NewReader(""), &out, nil)
+	if err == nil {
+		t.Errorf("CompressRangeLocation: expected empty file error")
+	}
+	_, err = CompressRangeLocation(strings.NewReader("1,2,3\n4,x,6\n"), &out, nil)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("CompressRangeLocation = %v, want line 2 error", err)
+	}
+}
+
+func TestGrid(t *testing.T) {
+	var gridTests = []struct {
+		res  float64
+		lat  float64
+		lon  float64
+		i, j int
+		code uint32
+	}{
+		{1, 37.4192, -122.0574, 127, 57, 127057},
+		{1, -90, -180, 0, 0, 0},
+		{1, 90, 180, 180, 360, 180360},
+		{0.1, 37.4192, -122.0574, 1274, 579, 1274*3601 + 579},
+		{0.25, -37.8139, 144.9634, 208, 1299, 208*1441 + 1299},
+		// grid lines
+		{0.1, -89.9, -179.9, 1, 1, 3601 + 1},
+		{0.1, 0.3, 0.7, 903, 1807, 903*3601 + 1807},
+		{0.1, 90, 180, 1800, 3600, 1800*3601 + 3600},
+		{0.2, -89.4, 12.6, 3, 963, 3*1801 + 963},
+	}
+	for _, tt := range gridTests {
+		g := Grid{tt.res}
+		i, j, ok := g.Cell(tt.lat, tt.lon)
+		if !ok || i != tt.i || j != tt.j {
+			t.Errorf("Grid{%g}.Cell(%g, %g) = %d, %d, %v", tt.res, tt.lat, tt.lon, i, j, ok)
+		}
+		if c := g.Encode(i, j); c != tt.code {
+			t.Errorf("Grid{%g}.Encode(%d, %d) = %d, want %d", tt.res, i, j, c, tt.code)
+		}
+		if di, dj := g.Decode(tt.code); di != i || dj != j {
+			t.Errorf("Grid{%g}.Decode(%d) = %d, %d", tt.res, tt.code, di, dj)
+		}
+		lat, lon := g.LatLon(i, j)
+		if lat > tt.lat+1e-9 || lat+tt.res < tt.lat || lon > tt.lon+1e-9 || lon+tt.res < tt.lon {
+			t.Errorf("Grid{%g}.LatLon(%d, %d) = %g, %g", tt.res, i, j, lat, lon)
+		}
+	}
+	if _, _, ok := DefaultGrid.Cell(91, 0); ok {
+		t.Errorf("Cell(91, 0) is in range")
+	}
+
+	for _, res := range []float64{0, -1, 0.7, 7, 181, 0.001, math.NaN(), math.Inf(1)} {
+		g := Grid{res}
+		if err := g.Check(); err != ErrBadGrid {
+			t.Errorf("Grid{%g}.Check() = %v", res, err)
+		}
+		if i, j, ok := g.Cell(10, 10); ok {
+			t.Errorf("Grid{%g}.Cell(10, 10) = %d, %d, %v", res, i, j, ok)
+		}
+		if _, err := g.UpdateRangeLocation(strings.NewReader(location), strings.NewReader(blocks), ioutil.Discard); err != ErrBadGrid {
+			t.Errorf("Grid{%g}.UpdateRangeLocation: %v", res, err)
+		}
+		if err := WriteRanges(ioutil.Discard, g, nil); err != ErrBadGrid {
+			t.Errorf("WriteRanges(Grid{%g}): %v", res, err)
+		}
+	}
+	for _, res := range []float64{0.01, 0.5, 2, 180} {
+		if err := (Grid{res}).Check(); err != nil {
+			t.Errorf("Grid{%g}.Check() = %v", res, err)
+		}
+	}
+}
+
+func TestUpdateFineGrid(t *testing.T) {
+	var ranges bytes.Buffer
+	g := Grid{0.1}
+	sum, err := g.UpdateRangeLocation(strings.NewReader(location), strings.NewReader(blocks), &ranges)
+	if err != nil {
+		t.Fatalf("UpdateRangeLocation: %v", err)
+	}
+	// Mountain View and Sunnyvale share a cell only on the 1 degree grid
+	if sum.Cells != 3 {
+		t.Errorf("UpdateRangeLocation = %+v", *sum)
+	}
+}
+
+func BenchmarkUpdateRangeLocation(b *testing.B) {
+	var loc, blk bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&loc, "%d,\"US\",\"\",\"\",\"\",%g,%g,,\n", i, float64(i%180)-89.5, float64(i%360)-179.5)
+	}
+	for i := 0; i < b.N; i++ {
+		fmt.Fprintf(&blk, "%d,%d,%d\n", i*256, i*256+255, i%10000)
+	}
+	b.ResetTimer()
+	UpdateRangeLocation(&loc, &blk, ioutil.Discard)
+}
+
+func TestRangeFile(t *testing.T) {
+	var csvOut, binOut bytes.Buffer
+	in := "16777216,16777471,52324\n134744064,134744319,127057\n134744320,134744575,127057\n"
+	if _, err := CompressRangeLocation(strings.NewReader(in), &csvOut, &binOut); err != nil {
+		t.Fatal(err)
+	}
+	data := binOut.Bytes()
+	g, rs, err := ReadRanges(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadRanges: %v", err)
+	}
+	if g != DefaultGrid || len(rs) != 2 || rs[1].Start.String() != "8.8.8.0" || rs[1].End.String() != "8.8.9.255" || rs[1].Cell != 127057 {
+		t.Errorf("ReadRanges = %v, %v", g, rs)
+	}
+
+	ipt := iptrie.NewIPTrie()
+	if err = LoadCompressedRanges(bytes.NewReader(data), ipt); err != nil {
+		t.Fatalf("LoadCompressedRanges: %v", err)
+	}
+	loc, ok := ipt.Get("8.8.9.1").(*geo.Loc)
+	if !ok || loc.Lat != 37.5 || loc.Lon != -122.5 {
+		t.Errorf("Get(8.8.9.1) = %v", loc)
+	}
+	if ipt.Get("8.8.10.1") != nil {
+		t.Errorf("Get(8.8.10.1) = %v", ipt.Get("8.8.10.1"))
+	}
+
+	data[30] ^= 0xff
+	if err = LoadCompressedRanges(bytes.NewReader(data), iptrie.NewIPTrie()); err != ErrChecksum {
+		t.Errorf("LoadCompressedRanges = %v, want ErrChecksum", err)
+	}
+}
+
+func TestRangeFileOverflow(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteRanges(&b, DefaultGrid, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 1<<62 records of 12 bytes wrap around to the empty body.
+	data := b.Bytes()
+	binary.BigEndian.PutUint64(data[16:], 1<<62)
+	body := data[:len(data)-4]
+	binary.BigEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+	if _, _, err := ReadRanges(bytes.NewReader(data)); err != ErrBadRangeFile {
+		t.Errorf("ReadRanges = %v, want ErrBadRangeFile", err)
+	}
+}
+
+func TestRangeFileBadCell(t *testing.T) {
+	for _, c := range []uint32{181000, 999, 180361} {
+		var b bytes.Buffer
+		rs := []RangeRecord{
+			{net.ParseIP("1.0.0.0"), net.ParseIP("1.0.0.255"), 127057},
+			{net.ParseIP("8.8.8.0"), net.ParseIP("8.8.8.255"), c},
+		}
+		if err := WriteRanges(&b, DefaultGrid, rs); err != nil {
+			t.Fatal(err)
+		}
+		ipt := iptrie.NewIPTrie()
+		if err := LoadCompressedRanges(&b, ipt); err != ErrBadRangeFile {
+			t.Errorf("LoadCompressedRanges with cell %d = %v, want ErrBadRangeFile", c, err)
+		}
+		if ipt.Get("1.0.0.1") != nil {
+			t.Errorf("LoadCompressedRanges with cell %d added ranges", c)
+		}
+	}
+}
+
+func TestRangeFileBadGrid(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteRanges(&b, DefaultGrid, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	binary.BigEndian.PutUint64(data[8:], math.Float64bits(0.001))
+	body := data[:len(data)-4]
+	binary.BigEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+	if _, _, err := ReadRanges(bytes.NewReader(data)); err != ErrBadRangeFile {
+		t.Errorf("ReadRanges of a 0.001 degree grid = %v, want ErrBadRangeFile", err)
+	}
+}
+
+func TestRangeFileIPv6(t *testing.T) {
+	g := Grid{0.1}
+	in := "2001:db8::,2001:db8::ffff,4588253\n2001:db8::1:0,2001:db8::1:ffff,4588253\n10.0.0.0,10.0.0.255,5\n"
+	var csvOut, binOut bytes.Buffer
+	sum, err := g.CompressRangeLocation(strings.NewReader(in), &csvOut, &binOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Written != 2 || csvOut.String() != "2001:db8::,2001:db8::1:ffff,4588253\n10.0.0.0,10.0.0.255,5\n" {
+		t.Errorf("CompressRangeLocation = %+v, %q", *sum, csvOut.String())
+	}
+	ipt := iptrie.NewIPTrie()
+	if err = LoadCompressedRanges(&binOut, ipt); err != nil {
+		t.Fatalf("LoadCompressedRanges: %v", err)
+	}
+	loc, ok := ipt.Get("2001:db8::1:1").(*geo.Loc)
+	if !ok || math.Abs(loc.Lat-37.45) > 1e-9 || math.Abs(loc.Lon+122.05) > 1e-9 {
+		t.Errorf("Get(2001:db8::1:1) = %v", loc)
+	}
+	if ipt.Get("10.0.0.7") == nil {
+		t.Errorf("Get(10.0.0.7) = nil")
+	}
+}
+
+func TestLegacyRangeFile(t *testing.T) {
+	var b bytes.Buffer
+	for _, v := range []uint32{16777216, 16777471, 52324, 134744064, 134744575, 127057} {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	binary.Write(&b, binary.LittleEndian, '\n')
+	ipt := iptrie.NewIPTrie()
+	if err := LoadCompressedRanges(&b, ipt); err != nil {
+		t.Fatalf("LoadCompressedRanges: %v", err)
+	}
+	if loc, ok := ipt.Get("1.0.0.1").(*geo.Loc); !ok || loc.Lat != -37.5 || loc.Lon != 144.5 {
+		t.Errorf("Get(1.0.0.1) = %v", loc)
+	}
+	if err := LoadCompressedRanges(strings.NewReader("junk"), ipt); err != ErrBadRangeFile {
+		t.Errorf("LoadCompressedRanges = %v, want ErrBadRangeFile", err)
+	}
+}
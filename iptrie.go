@@ -144,7 +144,10 @@ func (t *IPTrie) add(a []byte) *IPTrie {
 func (t *IPTrie) Get(addr string) interface{} {
 	ip := net.ParseIP(addr)
 	k, i := t.get(ip.To16())
-	if k.data != nil {
+	// A node reached before the end of the address may be the start of a
+	// range whose address ends in zero bytes.  Its children hold greater
+	// addresses, so they are searched first.
+	if k.data != nil && i == len(ip) {
 		return k.data
 	}
 	var b byte
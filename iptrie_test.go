@@ -311,6 +311,31 @@ func TestGet(t *testing.T) {
 	if tn != nil {
 		t.Error("5")
 	}
+
+	// The start of a range ending in zero bytes is an interior node; the
+	// addresses below it belong to later ranges.
+	tt.AddRange("10.1.0.0", "10.1.1.255", &testData{30})
+	tt.AddRange("10.1.2.0", "10.1.2.95", &testData{35})
+	tt.AddRange("10.1.2.96", "10.1.2.127", &testData{40})
+	tt.AddRange("10.1.2.128", "10.1.15.255", &testData{30})
+	for _, c := range []struct {
+		addr string
+		i    int
+	}{
+		{"10.1.0.0", 30},
+		{"10.1.1.7", 30},
+		{"10.1.2.0", 35},
+		{"10.1.2.95", 35},
+		{"10.1.2.118", 40},
+		{"10.1.2.200", 30},
+		{"10.1.15.255", 30},
+		{"10.1.16.0", 0},
+	} {
+		r, _ := tt.Get(c.addr).(*testData)
+		if r == nil && c.i != 0 || r != nil && r.i != c.i {
+			t.Errorf("Get(%s) = %v, want %d", c.addr, r, c.i)
+		}
+	}
 }
 
 func BenchmarkRndIPv4(b *testing.B) {
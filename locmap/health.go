@@ -0,0 +1,272 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Checker probes a server and returns an error if it is not healthy.
+type Checker interface {
+	Check(ctx context.Context, d Data) error
+}
+
+// CheckerFunc adapts a function to the Checker interface.
+type CheckerFunc func(ctx context.Context, d Data) error
+
+func (f CheckerFunc) Check(ctx context.Context, d Data) error {
+	return f(ctx, d)
+}
+
+// A TCPChecker considers a server healthy if it accepts a TCP connection.
+// The ServerId is the host to connect to.
+type TCPChecker struct {
+	Port string // port to connect to, or empty if ServerId includes the port
+}
+
+func (c TCPChecker) Check(ctx context.Context, d Data) error {
+	addr := d.ServerId
+	if c.Port != "" {
+		addr = net.JoinHostPort(d.ServerId, c.Port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// An HTTPChecker considers a server healthy if a GET request returns a 2xx or
+// 3xx status.
+type HTTPChecker struct {
+	URL    func(d Data) string // URL to get, http://ServerId/ if nil
+	Client *http.Client        // http.DefaultClient if nil
+}
+
+func (c HTTPChecker) Check(ctx context.Context, d Data) error {
+	url := "http://" + d.ServerId + "/"
+	if c.URL != nil {
+		url = c.URL(d)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("locmap: %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// A HealthChecker probes the registered servers of a LocationMap and sets
+// their status.  An offline server goes online after Rise successful probes
+// in a row and an online server goes offline after Fall failed probes in a
+// row; values below 1 count as 1.  Servers with the same ServerId are probed
+// once for all resources.
+type HealthChecker struct {
+	Map      *LocationMap
+	Checker  Checker
+	Interval time.Duration                        // time between rounds of probes
+	Jitter   float64                              // random fraction of Interval added or subtracted
+	Timeout  time.Duration                        // time a probe may take
+	Rise     int                                  // successful probes to go online
+	Fall     int                                  // failed probes to go offline
+	OnChange func(d Data, err error)              // called after the status of d was set, err is the failed probe
+	Rand     func() float64                       // random numbers in [0, 1) for the jitter, rand.Float64 if nil
+	After    func(time.Duration) <-chan time.Time // time.After if nil
+
+	mutex  sync.Mutex
+	state  map[serverKey]*probes
+	stopMu sync.Mutex // protects stop
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// probes counts the probes of a server that had the same result in a row.
+type probes struct {
+	ok, failed int
+}
+
+// NewHealthChecker creates a HealthChecker that probes every 10 seconds with
+// 10% jitter and a 2 second timeout and needs 2 successes or 3 failures to
+// change the status of a server.
+func NewHealthChecker(m *LocationMap, c Checker) *HealthChecker {
+	return &HealthChecker{
+		Map:      m,
+		Checker:  c,
+		Interval: 10 * time.Second,
+		Jitter:   0.1,
+		Timeout:  2 * time.Second,
+		Rise:     2,
+		Fall:     3,
+	}
+}
+
+// CheckAll probes every registered server once, sets the status of the
+// servers that reached a threshold and returns the servers whose status was
+// set.
+func (h *HealthChecker) CheckAll(ctx context.Context) []Data {
+
+	servers := h.Map.allServers()
+	byId := make(map[string][]Data)
+	for _, d := range servers {
+		byId[d.ServerId] = append(byId[d.ServerId], d)
+	}
+	errs := make(map[string]error, len(byId))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for id, ds := range byId {
+		wg.Add(1)
+		go func(id string, d Data) {
+			defer wg.Done()
+			pctx := ctx
+			if h.Timeout > 0 {
+				var cancel context.CancelFunc
+				pctx, cancel = context.WithTimeout(ctx, h.Timeout)
+				defer cancel()
+			}
+			err := h.Checker.Check(pctx, d)
+			mutex.Lock()
+			errs[id] = err
+			mutex.Unlock()
+		}(id, ds[0])
+	}
+	wg.Wait()
+
+	rise, fall := h.Rise, h.Fall
+	if rise < 1 {
+		rise = 1
+	}
+	if fall < 1 {
+		fall = 1
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	state := make(map[serverKey]*probes, len(servers))
+	var changed []Data
+	var changedErrs []error
+	for _, d := range servers {
+		k := serverKey{d.ResourceId, d.ServerId}
+		p := h.state[k]
+		if p == nil {
+			p = &probes{}
+		}
+		state[k] = p
+		err := errs[d.ServerId]
+		if err == nil {
+			p.ok, p.failed = p.ok+1, 0
+		} else {
+			p.ok, p.failed = 0, p.failed+1
+		}
+		if !d.Status && p.ok >= rise || d.Status && p.failed >= fall {
+			d.Status = !d.Status
+			if h.Map.SetStatus(d.ResourceId, d.ServerId, d.Status) == nil {
+				changed = append(changed, d)
+				changedErrs = append(changedErrs, err)
+			}
+		}
+	}
+	h.state = state // forget removed servers
+	if h.OnChange != nil {
+		for i, d := range changed {
+			h.OnChange(d, changedErrs[i])
+		}
+	}
+	return changed
+}
+
+// Start probes the servers every Interval until Stop is called.  Starting a
+// running HealthChecker does nothing.
+func (h *HealthChecker) Start() {
+	h.stopMu.Lock()
+	defer h.stopMu.Unlock()
+	if h.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	h.stop = stop
+	ctx, cancel := context.WithCancel(context.Background())
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer cancel()
+		for {
+			select {
+			case <-h.after(h.wait()):
+				h.CheckAll(ctx)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		<-stop
+		cancel()
+	}()
+}
+
+// Stop ends Start and waits for running probes to finish.  It may be called
+// more than once and on a HealthChecker that was never started.
+func (h *HealthChecker) Stop() {
+	h.stopMu.Lock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+	h.stopMu.Unlock()
+	h.wg.Wait()
+}
+
+func (h *HealthChecker) wait() time.Duration {
+	r := rand.Float64
+	if h.Rand != nil {
+		r = h.Rand
+	}
+	return h.Interval + time.Duration((2*r()-1)*h.Jitter*float64(h.Interval))
+}
+
+func (h *HealthChecker) after(d time.Duration) <-chan time.Time {
+	if h.After != nil {
+		return h.After(d)
+	}
+	return time.After(d)
+}
+
+// allServers returns the registered servers of all resources ordered by
+// ResourceId and ServerId.
+func (m *LocationMap) allServers() []Data {
+	m.rwmutex.RLock()
+	var ds []Data
+	for _, s := range m.servers {
+		for _, d := range s {
+			ds = append(ds, d)
+		}
+	}
+	m.rwmutex.RUnlock()
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].ResourceId != ds[j].ResourceId {
+			return ds[i].ResourceId < ds[j].ResourceId
+		}
+		return ds[i].ServerId < ds[j].ServerId
+	})
+	return ds
+}
@@ -0,0 +1,221 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerThresholds(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	m.AddServer(Data{Status: true, ResourceId: "2", ServerId: "a", Lat: 0, Lon: 0})
+	m.AddServer(Data{Status: false, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 60})
+
+	var mutex sync.Mutex
+	down := map[string]bool{"a": true}
+	probed := map[string]int{}
+	h := NewHealthChecker(m, CheckerFunc(func(ctx context.Context, d Data) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		probed[d.ServerId]++
+		if down[d.ServerId] {
+			return errors.New("down")
+		}
+		return nil
+	}))
+	var changes []string
+	h.OnChange = func(d Data, err error) {
+		changes = append(changes, d.ResourceId+"/"+d.ServerId)
+	}
+
+	ctx := context.Background()
+	if ds := h.CheckAll(ctx); len(ds) != 0 {
+		t.Errorf("first round changed %v", ds)
+	}
+	if probed["a"] != 1 {
+		t.Errorf("a was probed %d times for two resources, want 1", probed["a"])
+	}
+	if ds := h.CheckAll(ctx); len(ds) != 1 || ds[0].ServerId != "b" || !ds[0].Status {
+		t.Errorf("second round changed %v, want b online", ds)
+	}
+	if l, _ := m.GetServer(0, 50, "1"); l != "b" {
+		t.Errorf("GetServer = %q, want b", l)
+	}
+	if ds := h.CheckAll(ctx); len(ds) != 2 || ds[0].ServerId != "a" || ds[0].Status {
+		t.Errorf("third round changed %v, want a offline twice", ds)
+	}
+	if l, _ := m.GetServer(0, 0, "1"); l != "b" {
+		t.Errorf("GetServer = %q, want b", l)
+	}
+	if strings.Join(changes, " ") != "1/b 1/a 2/a" {
+		t.Errorf("OnChange calls = %v", changes)
+	}
+
+	// A success resets the failures.
+	mutex.Lock()
+	down["a"], down["b"] = false, true
+	mutex.Unlock()
+	h.CheckAll(ctx)
+	h.CheckAll(ctx)
+	mutex.Lock()
+	down["b"] = false
+	mutex.Unlock()
+	h.CheckAll(ctx)
+	mutex.Lock()
+	down["b"] = true
+	mutex.Unlock()
+	h.CheckAll(ctx)
+	h.CheckAll(ctx)
+	if l, _ := m.GetServer(0, 50, "1"); l != "b" {
+		t.Errorf("GetServer after broken failures = %q, want b", l)
+	}
+	if ds := h.CheckAll(ctx); len(ds) != 1 || ds[0].ServerId != "b" {
+		t.Errorf("round changed %v, want b offline", ds)
+	}
+}
+
+func TestHealthCheckerZeroThresholds(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	m.AddServer(Data{Status: false, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 60})
+	h := &HealthChecker{Map: m, Checker: CheckerFunc(func(ctx context.Context, d Data) error {
+		if d.ServerId == "a" {
+			return errors.New("down")
+		}
+		return nil
+	})}
+	// A succeeding server must not go offline and a failing one must not
+	// come online, however often they are probed.
+	for i := 0; i < 3; i++ {
+		h.CheckAll(context.Background())
+		for _, d := range m.Servers("1") {
+			if d.Status != (d.ServerId == "b") {
+				t.Errorf("round %d: %s online = %v", i, d.ServerId, d.Status)
+			}
+		}
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "sick", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer slow.Close()
+
+	c := HTTPChecker{URL: func(d Data) string {
+		return "http://" + d.ServerId + "/healthz"
+	}}
+	ctx := context.Background()
+	if err := c.Check(ctx, Data{ServerId: ok.Listener.Addr().String()}); err != nil {
+		t.Errorf("Check(ok): %v", err)
+	}
+	if err := c.Check(ctx, Data{ServerId: bad.Listener.Addr().String()}); err == nil {
+		t.Errorf("Check(bad) succeeded")
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := c.Check(tctx, Data{ServerId: slow.Listener.Addr().String()}); err == nil {
+		t.Errorf("Check(slow) succeeded")
+	}
+}
+
+func TestTCPChecker(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	ctx := context.Background()
+	if err := (TCPChecker{Port: port}).Check(ctx, Data{ServerId: host}); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+	if err := (TCPChecker{}).Check(ctx, Data{ServerId: l.Addr().String()}); err != nil {
+		t.Errorf("Check without Port: %v", err)
+	}
+	l.Close()
+	if err := (TCPChecker{Port: port}).Check(ctx, Data{ServerId: host}); err == nil {
+		t.Errorf("Check of a closed port succeeded")
+	}
+}
+
+func TestHealthCheckerStart(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	m := NewLocationMap(Resolution(10))
+	m.AddServer(Data{Status: false, ResourceId: "1", ServerId: srv.Listener.Addr().String(), Lat: 0, Lon: 0})
+
+	h := NewHealthChecker(m, HTTPChecker{})
+	h.Rand = func() float64 { return 1 }
+	waits := make(chan time.Duration, 10)
+	ticks := make(chan time.Time)
+	h.After = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return ticks
+	}
+	changed := make(chan Data, 1)
+	h.OnChange = func(d Data, err error) { changed <- d }
+	h.Start()
+	defer h.Stop()
+
+	for i := 0; i < h.Rise; i++ {
+		if d := <-waits; d != 11*time.Second {
+			t.Errorf("wait = %v, want 11s", d)
+		}
+		ticks <- time.Time{}
+	}
+	if d := <-changed; !d.Status {
+		t.Errorf("OnChange(%v), want online", d)
+	}
+	if l, _ := m.GetServer(0, 0, "1"); l != srv.Listener.Addr().String() {
+		t.Errorf("GetServer = %q", l)
+	}
+}
+
+func TestHealthCheckerStop(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10))
+	var mutex sync.Mutex
+	loops := 0
+	h := &HealthChecker{Map: m, Checker: TCPChecker{}, Interval: time.Hour}
+	h.After = func(d time.Duration) <-chan time.Time {
+		mutex.Lock()
+		loops++
+		mutex.Unlock()
+		return nil
+	}
+	h.Stop() // never started
+	h.Start()
+	h.Start()
+	h.Stop()
+	h.Stop()
+	if loops != 1 {
+		t.Errorf("%d probe loops ran, want 1", loops)
+	}
+	h.Start() // restart after Stop
+	h.Stop()
+	if loops != 2 {
+		t.Errorf("%d probe loops ran after a restart, want 2", loops)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"code.google.com/p/iptrie/geo"
+)
+
+// An Index finds the closest server of a resource exactly.  The servers of
+// each resource are kept in a k-d tree on the unit vectors of their
+// locations, where the straight line distance between two vectors grows with
+// the great circle distance between the locations.  Adding and removing a
+// server takes O(log n) amortized time and memory does not depend on a grid.
+// Removed servers are only marked and the tree is rebuilt once half of its
+// nodes are removed or it becomes too deep.
+type Index struct {
+	mutex sync.RWMutex
+	trees map[string]*kdTree // ResourceId --> servers
+}
+
+type kdNode struct {
+	p           [3]float64
+	data        Data
+	axis        int
+	removed     bool
+	left, right *kdNode
+}
+
+type kdTree struct {
+	root    *kdNode
+	nodes   map[string]*kdNode // ServerId --> node of an online server
+	removed int
+	depth   int
+}
+
+// NewIndex creates an empty Index.
+func NewIndex() *Index {
+	return &Index{
+		trees: make(map[string]*kdTree),
+	}
+}
+
+// unitVector returns the point on the unit sphere of a location.
+func unitVector(lat, lon float64) [3]float64 {
+	la, lo := lat*math.Pi/180, lon*math.Pi/180
+	return [3]float64{
+		math.Cos(la) * math.Cos(lo),
+		math.Cos(la) * math.Sin(lo),
+		math.Sin(la),
+	}
+}
+
+func chord2(a, b [3]float64) float64 {
+	dx, dy, dz := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dx*dx + dy*dy + dz*dz
+}
+
+// Update adds an online server, moves it if its location changed, or removes
+// an offline server.
+func (x *Index) Update(e *Data) {
+
+	if e == nil {
+		return
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	t := x.trees[e.ResourceId]
+	if t == nil {
+		if !e.Status {
+			return
+		}
+		t = &kdTree{nodes: make(map[string]*kdNode)}
+		x.trees[e.ResourceId] = t
+	}
+	t.remove(e.ServerId)
+	if e.Status {
+		t.insert(e)
+	}
+	if len(t.nodes) == 0 {
+		delete(x.trees, e.ResourceId)
+	}
+}
+
+// GetServer returns the serverId of the closest online server of a resource.
+func (x *Index) GetServer(lat, lon float64, resourceId string) (string, error) {
+
+	if lat < LoLat || lat > HiLat || lon < LoLon || lon > HiLon {
+		return "", BadLocation
+	}
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	t := x.trees[resourceId]
+	if t == nil {
+		return "", nil
+	}
+	var best *kdNode
+	bestDist := math.MaxFloat64
+	t.nearest(t.root, unitVector(lat, lon), &best, &bestDist)
+	if best == nil {
+		return "", nil
+	}
+	return best.data.ServerId, nil
+}
+
+// GetServers returns up to k online servers of a resource ordered by their
+// distance to a location.
+func (x *Index) GetServers(lat, lon float64, resourceId string, k int) ([]Candidate, error) {
+
+	if lat < LoLat || lat > HiLat || lon < LoLon || lon > HiLon {
+		return nil, BadLocation
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+	x.mutex.RLock()
+	t := x.trees[resourceId]
+	var ns []nodeDist
+	if t != nil {
+		ns = t.kNearest(t.root, unitVector(lat, lon), k, nil)
+	}
+	x.mutex.RUnlock()
+	cs := make([]Candidate, len(ns))
+	for i, n := range ns {
+		cs[i] = Candidate{n.node.data, geo.Distance(lat, lon, n.node.data.Lat, n.node.data.Lon)}
+	}
+	sortCandidates(cs)
+	return cs, nil
+}
+
+func (t *kdTree) remove(serverId string) {
+	n := t.nodes[serverId]
+	if n == nil {
+		return
+	}
+	n.removed = true
+	delete(t.nodes, serverId)
+	t.removed++
+	if t.removed > len(t.nodes) {
+		t.rebuild()
+	}
+}
+
+func (t *kdTree) insert(e *Data) {
+	n := &kdNode{p: unitVector(e.Lat, e.Lon), data: *e}
+	t.nodes[e.ServerId] = n
+	depth := 1
+	link := &t.root
+	for *link != nil {
+		p := *link
+		n.axis = (p.axis + 1) % 3
+		if n.p[p.axis] < p.p[p.axis] {
+			link = &p.left
+		} else {
+			link = &p.right
+		}
+		depth++
+	}
+	*link = n
+	if depth > t.depth {
+		t.depth = depth
+	}
+	// A balanced tree has a depth of about log2(n).
+	if t.depth > 2*bitLen(len(t.nodes))+8 {
+		t.rebuild()
+	}
+}
+
+func bitLen(n int) int {
+	l := 0
+	for ; n > 0; n >>= 1 {
+		l++
+	}
+	return l
+}
+
+// rebuild builds a balanced tree from the online servers.
+func (t *kdTree) rebuild() {
+	ns := make([]*kdNode, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		n.left, n.right = nil, nil
+		ns = append(ns, n)
+	}
+	t.removed = 0
+	t.depth = 0
+	t.root = t.build(ns, 0, 1)
+}
+
+func (t *kdTree) build(ns []*kdNode, axis, depth int) *kdNode {
+	if len(ns) == 0 {
+		return nil
+	}
+	sort.Slice(ns, func(i, j int) bool {
+		return ns[i].p[axis] < ns[j].p[axis]
+	})
+	m := len(ns) / 2
+	n := ns[m]
+	n.axis = axis
+	if depth > t.depth {
+		t.depth = depth
+	}
+	n.left = t.build(ns[:m], (axis+1)%3, depth+1)
+	n.right = t.build(ns[m+1:], (axis+1)%3, depth+1)
+	return n
+}
+
+type nodeDist struct {
+	node *kdNode
+	dist float64 // squared chord length
+}
+
+// kNearest adds the nodes of the subtree at n that are among the k nearest to
+// p to ns, which is ordered by distance, and returns ns.
+func (t *kdTree) kNearest(n *kdNode, p [3]float64, k int, ns []nodeDist) []nodeDist {
+	if n == nil {
+		return ns
+	}
+	if !n.removed {
+		d := chord2(n.p, p)
+		if len(ns) < k || d < ns[len(ns)-1].dist {
+			i := sort.Search(len(ns), func(i int) bool { return ns[i].dist > d })
+			if len(ns) < k {
+				ns = append(ns, nodeDist{})
+			}
+			copy(ns[i+1:], ns[i:])
+			ns[i] = nodeDist{n, d}
+		}
+	}
+	diff := p[n.axis] - n.p[n.axis]
+	near, far := n.left, n.right
+	if diff >= 0 {
+		near, far = n.right, n.left
+	}
+	ns = t.kNearest(near, p, k, ns)
+	if len(ns) < k || diff*diff < ns[len(ns)-1].dist {
+		ns = t.kNearest(far, p, k, ns)
+	}
+	return ns
+}
+
+func (t *kdTree) nearest(n *kdNode, p [3]float64, best **kdNode, bestDist *float64) {
+	if n == nil {
+		return
+	}
+	if !n.removed {
+		if d := chord2(n.p, p); d < *bestDist {
+			*best, *bestDist = n, d
+		}
+	}
+	diff := p[n.axis] - n.p[n.axis]
+	near, far := n.left, n.right
+	if diff >= 0 {
+		near, far = n.right, n.left
+	}
+	t.nearest(near, p, best, bestDist)
+	if diff*diff < *bestDist {
+		t.nearest(far, p, best, bestDist)
+	}
+}
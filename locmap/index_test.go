@@ -0,0 +1,181 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"code.google.com/p/iptrie/geo"
+)
+
+func bruteForce(servers map[string]Data, lat, lon float64) string {
+	serverId := ""
+	distMin := math.MaxFloat64
+	for _, d := range servers {
+		if dist := geo.Distance(lat, lon, d.Lat, d.Lon); dist < distMin {
+			serverId = d.ServerId
+			distMin = dist
+		}
+	}
+	return serverId
+}
+
+func TestIndexGetServer(t *testing.T) {
+
+	x := NewIndex()
+	if _, err := x.GetServer(0, 400, "1"); err != BadLocation {
+		t.Errorf("GetServer: boundary check failed")
+	}
+	if l, err := x.GetServer(0, 0, "1"); l != "" || err != nil {
+		t.Errorf("GetServer on empty index = %q, %v", l, err)
+	}
+
+	servers := []Data{
+		{Status: true, ResourceId: "1", ServerId: "west", Lat: 10, Lon: 20.1},
+		{Status: true, ResourceId: "1", ServerId: "east", Lat: 10, Lon: 20.8},
+		{Status: true, ResourceId: "2", ServerId: "pacific", Lat: 0, Lon: 179.9},
+	}
+	for i := range servers {
+		x.Update(&servers[i])
+	}
+	var tests = []struct {
+		lat, lon   float64
+		resourceId string
+		want       string
+	}{
+		{10.5, 20.7, "1", "east"},
+		{10.5, 20.3, "1", "west"},
+		{0, -179.9, "2", "pacific"},
+		{0, 0, "3", ""},
+	}
+	for _, tt := range tests {
+		if l, _ := x.GetServer(tt.lat, tt.lon, tt.resourceId); l != tt.want {
+			t.Errorf("GetServer(%v, %v, %q) = %q, want %q", tt.lat, tt.lon, tt.resourceId, l, tt.want)
+		}
+	}
+
+	servers[1].Status = false
+	x.Update(&servers[1])
+	if l, _ := x.GetServer(10.5, 20.7, "1"); l != "west" {
+		t.Errorf("GetServer after removal = %q, want west", l)
+	}
+
+	// Moving a server replaces its old location.
+	servers[0].Lat, servers[0].Lon = -33, 151
+	x.Update(&servers[0])
+	servers[1].Status = true
+	x.Update(&servers[1])
+	if l, _ := x.GetServer(-30, 150, "1"); l != "west" {
+		t.Errorf("GetServer after move = %q, want west", l)
+	}
+	if l, _ := x.GetServer(10, 20, "1"); l != "east" {
+		t.Errorf("GetServer after move = %q, want east", l)
+	}
+}
+
+func TestIndexRandom(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	x := NewIndex()
+	online := make(map[string]Data)
+	for i := 0; i < 5000; i++ {
+		id := fmt.Sprint(r.Intn(500))
+		e := Data{
+			Status:     r.Intn(3) != 0,
+			ResourceId: "1",
+			ServerId:   id,
+			Lat:        r.Float64()*180 - 90,
+			Lon:        r.Float64()*360 - 180,
+		}
+		x.Update(&e)
+		if e.Status {
+			online[id] = e
+		} else {
+			delete(online, id)
+		}
+		if i%50 != 0 {
+			continue
+		}
+		for k := 0; k < 20; k++ {
+			lat, lon := r.Float64()*180-90, r.Float64()*360-180
+			got, _ := x.GetServer(lat, lon, "1")
+			want := bruteForce(online, lat, lon)
+			if got != want && geo.Distance(lat, lon, online[got].Lat, online[got].Lon) != geo.Distance(lat, lon, online[want].Lat, online[want].Lon) {
+				t.Fatalf("GetServer(%v, %v) = %q, want %q", lat, lon, got, want)
+			}
+		}
+	}
+}
+
+func TestIndexGetServers(t *testing.T) {
+
+	r := rand.New(rand.NewSource(2))
+	x := NewIndex()
+	m := NewLocationMap(Resolution(10))
+	for i := 0; i < 300; i++ {
+		e := Data{
+			Status:     true,
+			ResourceId: "1",
+			ServerId:   fmt.Sprint(i),
+			Lat:        r.Float64()*180 - 90,
+			Lon:        r.Float64()*360 - 180,
+		}
+		x.Update(&e)
+		m.Update(&e, nil)
+	}
+	if cs, _ := x.GetServers(0, 0, "1", 0); len(cs) != 0 {
+		t.Errorf("GetServers(k=0) = %v", cs)
+	}
+	for i := 0; i < 100; i++ {
+		lat, lon := r.Float64()*180-90, r.Float64()*360-180
+		got, _ := x.GetServers(lat, lon, "1", 5)
+		want, _ := m.GetServers(lat, lon, "1", 5)
+		if len(got) != 5 {
+			t.Fatalf("GetServers: got %d servers, want 5", len(got))
+		}
+		for j := range got {
+			if got[j].ServerId != want[j].ServerId || got[j].Dist != want[j].Dist {
+				t.Fatalf("GetServers(%v, %v)[%d] = %v, want %v", lat, lon, j, got[j], want[j])
+			}
+		}
+	}
+}
+
+func BenchmarkIndexUpdate(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	x := NewIndex()
+	for i := 0; i < b.N; i++ {
+		e := Data{
+			Status:     r.Intn(3) != 0,
+			ResourceId: "1",
+			ServerId:   fmt.Sprint(r.Intn(10000)),
+			Lat:        r.Float64()*180 - 90,
+			Lon:        r.Float64()*360 - 180,
+		}
+		x.Update(&e)
+	}
+}
+
+func BenchmarkIndexGetServer(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	x := NewIndex()
+	for i := 0; i < 10000; i++ {
+		e := Data{
+			Status:     true,
+			ResourceId: "1",
+			ServerId:   fmt.Sprint(i),
+			Lat:        r.Float64()*180 - 90,
+			Lon:        r.Float64()*360 - 180,
+		}
+		x.Update(&e)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.GetServer(r.Float64()*180-90, r.Float64()*360-180, "1")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Client is what is known about the client a server is chosen for.
+type Client struct {
+	IP      string
+	Country string // ISO 3166-1 alpha-2 code
+	Region  string
+	ASN     int64
+	Lat     float64
+	Lon     float64
+}
+
+// A LatencyProvider reports the measured round trip time between a client and
+// a server.
+type LatencyProvider interface {
+	RTT(c Client, serverId string) (time.Duration, bool)
+}
+
+// Latency makes the LocationMap choose servers by the round trip times the
+// provider reports, for clients passed to GetServerForClient or a Router.
+// Servers without a measurement are chosen by distance when none of the
+// candidates has one.
+func Latency(p LatencyProvider) Option {
+	return func(m *LocationMap) {
+		m.latency = p
+	}
+}
+
+// A LatencyMatrix holds measured round trip times from groups of clients to
+// servers.  A client is matched by its longest matching prefix, then by its
+// AS, its region and its country, and the first group with a measurement for
+// the server is used.
+type LatencyMatrix struct {
+	mutex     sync.RWMutex
+	prefixes  map[int]map[string]map[string]time.Duration // prefix length --> network --> ServerId --> RTT
+	lengths   []int                                       // prefix lengths in prefixes, longest first
+	asns      map[int64]map[string]time.Duration
+	regions   map[string]map[string]time.Duration // "country/region" --> ServerId --> RTT
+	countries map[string]map[string]time.Duration
+}
+
+// NewLatencyMatrix creates an empty LatencyMatrix.
+func NewLatencyMatrix() *LatencyMatrix {
+	return &LatencyMatrix{
+		prefixes:  make(map[int]map[string]map[string]time.Duration),
+		asns:      make(map[int64]map[string]time.Duration),
+		regions:   make(map[string]map[string]time.Duration),
+		countries: make(map[string]map[string]time.Duration),
+	}
+}
+
+// SetPrefix sets the RTT from the clients in cidr to a server.
+func (x *LatencyMatrix) SetPrefix(cidr, serverId string, rtt time.Duration) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96 // IPv4 addresses are matched in their 16 byte form
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	nets := x.prefixes[ones]
+	if nets == nil {
+		nets = make(map[string]map[string]time.Duration)
+		x.prefixes[ones] = nets
+		x.lengths = append(x.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(x.lengths)))
+	}
+	key := string(n.IP.To16())
+	setRTT(nets, key, serverId, rtt)
+	return nil
+}
+
+// SetASN sets the RTT from the clients in an AS to a server.
+func (x *LatencyMatrix) SetASN(asn int64, serverId string, rtt time.Duration) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.asns[asn] == nil {
+		x.asns[asn] = make(map[string]time.Duration)
+	}
+	x.asns[asn][serverId] = rtt
+}
+
+// SetRegion sets the RTT from the clients in a region to a server.  If
+// region is empty the RTT is used for the whole country.
+func (x *LatencyMatrix) SetRegion(country, region, serverId string, rtt time.Duration) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if region == "" {
+		setRTT(x.countries, country, serverId, rtt)
+	} else {
+		setRTT(x.regions, country+"/"+region, serverId, rtt)
+	}
+}
+
+func setRTT(m map[string]map[string]time.Duration, key, serverId string, rtt time.Duration) {
+	if m[key] == nil {
+		m[key] = make(map[string]time.Duration)
+	}
+	m[key][serverId] = rtt
+}
+
+// RTT returns the RTT of the most specific group of the client that has a
+// measurement for the server.
+func (x *LatencyMatrix) RTT(c Client, serverId string) (time.Duration, bool) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	if ip := net.ParseIP(c.IP); ip != nil {
+		ip = ip.To16()
+		for _, l := range x.lengths {
+			key := string(ip.Mask(net.CIDRMask(l, 8*net.IPv6len)))
+			if rtt, ok := x.prefixes[l][key][serverId]; ok {
+				return rtt, true
+			}
+		}
+	}
+	if rtt, ok := x.asns[c.ASN][serverId]; ok && c.ASN != 0 {
+		return rtt, true
+	}
+	if rtt, ok := x.regions[c.Country+"/"+c.Region][serverId]; ok && c.Region != "" {
+		return rtt, true
+	}
+	if rtt, ok := x.countries[c.Country][serverId]; ok && c.Country != "" {
+		return rtt, true
+	}
+	return 0, false
+}
+
+// ReadCSV adds the measurements of a CSV file with the columns kind, group,
+// ServerId and RTT in milliseconds, for example
+//
+//	prefix,203.0.113.0/24,syd1,12.5
+//	asn,AS15169,sjc2,3
+//	region,US/CA,sjc2,8
+//	country,AU,syd1,40
+//
+// An optional first line naming the columns and lines starting with # are
+// skipped.
+func (x *LatencyMatrix) ReadCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 4
+	cr.TrimLeadingSpace = true
+	for first := true; ; first = false {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if first && row[0] == "kind" {
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		ms, err := strconv.ParseFloat(row[3], 64)
+		if err != nil || ms < 0 || math.IsInf(ms, 0) {
+			return fmt.Errorf("locmap: latency line %d: bad RTT %q", line, row[3])
+		}
+		rtt := time.Duration(ms * float64(time.Millisecond))
+		switch row[0] {
+		case "prefix":
+			if err := x.SetPrefix(row[1], row[2], rtt); err != nil {
+				return fmt.Errorf("locmap: latency line %d: %v", line, err)
+			}
+		case "asn":
+			asn, err := strconv.ParseInt(strings.TrimPrefix(strings.ToUpper(row[1]), "AS"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("locmap: latency line %d: bad AS %q", line, row[1])
+			}
+			x.SetASN(asn, row[2], rtt)
+		case "region":
+			i := strings.Index(row[1], "/")
+			if i <= 0 || i == len(row[1])-1 {
+				return fmt.Errorf("locmap: latency line %d: bad region %q", line, row[1])
+			}
+			x.SetRegion(row[1][:i], row[1][i+1:], row[2], rtt)
+		case "country":
+			x.SetRegion(row[1], "", row[2], rtt)
+		default:
+			return fmt.Errorf("locmap: latency line %d: unknown kind %q", line, row[0])
+		}
+	}
+}
+
+// GetServerForClient returns the serverId of the online server of a resource
+// with the lowest measured RTT to the client.  Without a Latency option or a
+// measurement it returns the server GetServerFor picks for the location of
+// the client.
+func (m *LocationMap) GetServerForClient(c Client, resourceId, key string) (string, error) {
+	if m.latency == nil {
+		return m.GetServerFor(c.Lat, c.Lon, resourceId, key)
+	}
+	cs, err := m.GetServers(c.Lat, c.Lon, resourceId, math.MaxInt32)
+	if err != nil && err != ErrStaleData || len(cs) == 0 {
+		return "", err
+	}
+	return m.choose(c, cs, resourceId, key).ServerId, err
+}
+
+// choose picks a server among candidates ordered by distance, by RTT if any
+// of them has a measurement and by the policy of the resource otherwise.
+func (m *LocationMap) choose(c Client, cs []Candidate, resourceId, key string) Candidate {
+	if m.latency != nil {
+		best, bestRTT := -1, time.Duration(math.MaxInt64)
+		for i, cand := range cs {
+			if rtt, ok := m.latency.RTT(c, cand.ServerId); ok && rtt < bestRTT {
+				best, bestRTT = i, rtt
+			}
+		}
+		if best >= 0 {
+			return cs[best]
+		}
+	}
+	return m.policy(resourceId).pick(cs, key)
+}
@@ -0,0 +1,136 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/iptrie/geo"
+)
+
+const testLatency = `kind,group,server,rtt_ms
+# measured by RUM
+prefix,8.8.0.0/16,syd,300
+prefix,8.8.8.0/24,yyz,20
+prefix,2001:4860::/32,yyz,25
+asn,AS15169,syd,250
+asn,577,sjc,15
+region,CA/ON,syd,100
+country,CA,yyz,30.5
+`
+
+func TestLatencyMatrix(t *testing.T) {
+
+	x := NewLatencyMatrix()
+	if err := x.ReadCSV(strings.NewReader(testLatency)); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		c        Client
+		serverId string
+		rtt      time.Duration
+		ok       bool
+	}{
+		{Client{IP: "8.8.8.8"}, "yyz", 20 * time.Millisecond, true},
+		{Client{IP: "8.8.9.9"}, "yyz", 0, false},
+		{Client{IP: "8.8.9.9"}, "syd", 300 * time.Millisecond, true},
+		{Client{IP: "8.8.8.8", ASN: 15169}, "syd", 300 * time.Millisecond, true},
+		{Client{IP: "9.9.9.9", ASN: 15169}, "syd", 250 * time.Millisecond, true},
+		{Client{IP: "2001:4860::1"}, "yyz", 25 * time.Millisecond, true},
+		{Client{ASN: 577}, "sjc", 15 * time.Millisecond, true},
+		{Client{Country: "CA", Region: "ON"}, "syd", 100 * time.Millisecond, true},
+		{Client{Country: "CA", Region: "ON"}, "yyz", 30500 * time.Microsecond, true},
+		{Client{Country: "CA", Region: "QC"}, "syd", 0, false},
+		{Client{}, "yyz", 0, false},
+	}
+	for _, tt := range tests {
+		rtt, ok := x.RTT(tt.c, tt.serverId)
+		if rtt != tt.rtt || ok != tt.ok {
+			t.Errorf("RTT(%+v, %s) = %v, %v; want %v, %v", tt.c, tt.serverId, rtt, ok, tt.rtt, tt.ok)
+		}
+	}
+}
+
+func TestLatencyCSVErrors(t *testing.T) {
+
+	for _, in := range []string{
+		"prefix,8.8.8.8,a,1\n",
+		"asn,ASX,a,1\n",
+		"region,US,a,1\n",
+		"city,Paris,a,1\n",
+		"country,US,a,fast\n",
+		"country,US,a,-1\n",
+		"country,US,a\n",
+	} {
+		if err := NewLatencyMatrix().ReadCSV(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadCSV(%q) succeeded", in)
+		}
+	}
+	err := NewLatencyMatrix().ReadCSV(strings.NewReader("country,US,a,1\nasn,x,a,1\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("ReadCSV error %v does not name line 2", err)
+	}
+}
+
+func TestGetServerForClient(t *testing.T) {
+
+	x := NewLatencyMatrix()
+	x.SetRegion("US", "", "far", 10*time.Millisecond)
+	m := NewLocationMap(Resolution(10), Latency(x))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "near", Lat: 0, Lon: 0})
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "far", Lat: 0, Lon: 90})
+	if l, _ := m.GetServerForClient(Client{Country: "US"}, "1", ""); l != "far" {
+		t.Errorf("GetServerForClient with a measurement = %q, want far", l)
+	}
+	if l, _ := m.GetServerForClient(Client{Country: "AU"}, "1", ""); l != "near" {
+		t.Errorf("GetServerForClient without a measurement = %q, want near", l)
+	}
+	m.SetStatus("1", "far", false)
+	if l, _ := m.GetServerForClient(Client{Country: "US"}, "1", ""); l != "near" {
+		t.Errorf("GetServerForClient with the measured server offline = %q, want near", l)
+	}
+}
+
+func TestRouteLatency(t *testing.T) {
+
+	db, err := geo.OpenDB("../geo/testdata/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewLatencyMatrix()
+	if err := x.ReadCSV(strings.NewReader(testLatency)); err != nil {
+		t.Fatal(err)
+	}
+	m := NewLocationMap(Resolution(10), Latency(x))
+	for _, d := range []Data{
+		{ServerId: "sjc", Lat: 37.3, Lon: -121.9, Country: "US"},
+		{ServerId: "yyz", Lat: 43.7, Lon: -79.6, Country: "CA"},
+		{ServerId: "syd", Lat: -33.9, Lon: 151.2, Country: "AU"},
+	} {
+		d.Status, d.ResourceId = true, "1"
+		m.AddServer(d)
+		d.ResourceId = "ca"
+		m.AddServer(d)
+	}
+	r := NewRouter(db, m)
+	r.Rules["ca"] = Rule{SameCountry: true}
+	var tests = []struct {
+		ip, resourceId, serverId string
+	}{
+		{"8.8.8.8", "1", "yyz"},     // prefix
+		{"67.202.1.1", "1", "sjc"},  // AS577
+		{"67.202.1.1", "ca", "yyz"}, // the rule removes sjc and syd
+		{"1.0.0.1", "1", "syd"},     // no measurement, nearest
+		{"24.48.0.1", "1", "yyz"},   // country
+	}
+	for _, tt := range tests {
+		d, err := r.Route(tt.ip, tt.resourceId)
+		if err != nil || d.ServerId != tt.serverId {
+			t.Errorf("Route(%s, %s) = %s, %v; want %s", tt.ip, tt.resourceId, d.ServerId, err, tt.serverId)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrStaleData = errors.New("locmap: server data is stale")
+
+type serverKey struct {
+	resourceId string
+	serverId   string
+}
+
+// Lease makes servers expire d after they were last added, had their status
+// set or sent a heartbeat.  Expired servers are removed by Expire.  Without
+// this option servers never expire.
+func Lease(d time.Duration) Option {
+	return func(m *LocationMap) {
+		m.lease = d
+	}
+}
+
+// MaxAge makes GetServer return ErrStaleData when no server was added, had
+// its status set or sent a heartbeat for longer than d.  Removing or expiring
+// servers does not count as an update.  Without this option the data never becomes stale.
+func MaxAge(d time.Duration) Option {
+	return func(m *LocationMap) {
+		m.maxAge = d
+	}
+}
+
+// Clock replaces time.Now for leases and data age, for example in tests.
+func Clock(now func() time.Time) Option {
+	return func(m *LocationMap) {
+		m.now = now
+	}
+}
+
+// stale returns ErrStaleData if the data is older than maxAge.  The caller
+// must hold m.rwmutex.
+func (m *LocationMap) stale() error {
+	if m.maxAge > 0 && m.now().After(m.dataExp) {
+		return ErrStaleData
+	}
+	return nil
+}
+
+// Heartbeat renews the lease of a server and the age of the data.
+func (m *LocationMap) Heartbeat(resourceId, serverId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rwmutex.Lock()
+	defer m.rwmutex.Unlock()
+	if _, ok := m.servers[resourceId][serverId]; !ok {
+		return ErrUnknownServer
+	}
+	now := m.now()
+	if m.lease > 0 {
+		m.expires[serverKey{resourceId, serverId}] = now.Add(m.lease)
+	}
+	m.dataExp = now.Add(m.maxAge)
+	return nil
+}
+
+// Expire removes the servers whose lease ended and returns them ordered by
+// ResourceId and ServerId.
+func (m *LocationMap) Expire() []Data {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	var us []update
+	for k, exp := range m.expires {
+		if now.After(exp) {
+			us = append(us, update{m.servers[k.resourceId][k.serverId], true})
+		}
+	}
+	if len(us) == 0 {
+		return nil
+	}
+	sort.Slice(us, func(i, j int) bool {
+		if us[i].d.ResourceId != us[j].d.ResourceId {
+			return us[i].d.ResourceId < us[j].d.ResourceId
+		}
+		return us[i].d.ServerId < us[j].d.ServerId
+	})
+	m.apply(us)
+	ds := make([]Data, len(us))
+	for i, u := range us {
+		ds[i] = u.d
+	}
+	return ds
+}
+
+// ExpireEvery calls Expire every d until stop is called.  stop may be called
+// more than once.
+func (m *LocationMap) ExpireEvery(d time.Duration) (stop func()) {
+	done := make(chan struct{})
+	tk := time.NewTicker(d)
+	go func() {
+		defer tk.Stop()
+		for {
+			select {
+			case <-tk.C:
+				m.Expire()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	t     time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.t = c.t.Add(d)
+	c.mutex.Unlock()
+}
+
+func TestLease(t *testing.T) {
+
+	c := &fakeClock{t: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewLocationMap(Resolution(10), Lease(time.Minute), Clock(c.Now))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 60})
+
+	c.Advance(40 * time.Second)
+	if err := m.Heartbeat("1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Heartbeat("1", "c"); err != ErrUnknownServer {
+		t.Errorf("Heartbeat of unknown server: err = %v", err)
+	}
+	if ds := m.Expire(); len(ds) != 0 {
+		t.Errorf("Expire before the lease ended = %v", ds)
+	}
+
+	c.Advance(40 * time.Second)
+	ds := m.Expire()
+	if len(ds) != 1 || ds[0].ServerId != "b" {
+		t.Fatalf("Expire = %v, want b", ds)
+	}
+	if l, _ := m.GetServer(0, 50, "1"); l != "a" {
+		t.Errorf("GetServer after b expired = %q, want a", l)
+	}
+	if len(m.Servers("1")) != 1 {
+		t.Errorf("Servers after Expire = %v", m.Servers("1"))
+	}
+
+	// Setting the status renews the lease.
+	c.Advance(40 * time.Second)
+	m.SetStatus("1", "a", true)
+	c.Advance(40 * time.Second)
+	if ds := m.Expire(); len(ds) != 0 {
+		t.Errorf("Expire after SetStatus = %v", ds)
+	}
+	c.Advance(40 * time.Second)
+	if ds := m.Expire(); len(ds) != 1 {
+		t.Errorf("Expire = %v, want a", ds)
+	}
+	if l, _ := m.GetServer(0, 50, "1"); l != "" {
+		t.Errorf("GetServer after all servers expired = %q", l)
+	}
+}
+
+func TestNoLease(t *testing.T) {
+
+	c := &fakeClock{t: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewLocationMap(Resolution(10), Clock(c.Now))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	c.Advance(1000 * time.Hour)
+	if ds := m.Expire(); len(ds) != 0 {
+		t.Errorf("Expire without leases = %v", ds)
+	}
+	if _, err := m.GetServer(0, 0, "1"); err != nil {
+		t.Errorf("GetServer without MaxAge: err = %v", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+
+	c := &fakeClock{t: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewLocationMap(Resolution(10), MaxAge(time.Minute), Clock(c.Now))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	m.SetPolicy("2", Policy{Kind: LeastLoaded, Radius: 100})
+	m.AddServer(Data{Status: true, ResourceId: "2", ServerId: "a", Lat: 0, Lon: 0})
+
+	c.Advance(50 * time.Second)
+	if l, err := m.GetServer(0, 0, "1"); l != "a" || err != nil {
+		t.Errorf("GetServer = %q, %v", l, err)
+	}
+	c.Advance(20 * time.Second)
+	if l, err := m.GetServer(0, 0, "1"); l != "a" || err != ErrStaleData {
+		t.Errorf("GetServer with stale data = %q, %v", l, err)
+	}
+	if l, err := m.GetServerFor(0, 0, "2", "k"); l != "a" || err != ErrStaleData {
+		t.Errorf("GetServerFor with stale data = %q, %v", l, err)
+	}
+	m.Heartbeat("1", "a")
+	if _, err := m.GetServer(0, 0, "1"); err != nil {
+		t.Errorf("GetServer after Heartbeat: err = %v", err)
+	}
+}
+
+func TestMaxAgeExpire(t *testing.T) {
+
+	c := &fakeClock{t: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewLocationMap(Resolution(10), Lease(5*time.Minute), MaxAge(time.Minute), Clock(c.Now))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	c.Advance(3 * time.Minute)
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 90})
+	c.Advance(2*time.Minute + time.Second)
+	if l, err := m.GetServer(0, 0, "1"); l != "a" || err != ErrStaleData {
+		t.Errorf("GetServer with stale data = %q, %v", l, err)
+	}
+	if ds := m.Expire(); len(ds) != 1 || ds[0].ServerId != "a" {
+		t.Fatalf("Expire = %v, want a", ds)
+	}
+	if l, err := m.GetServer(0, 0, "1"); l != "b" || err != ErrStaleData {
+		t.Errorf("GetServer after Expire = %q, %v; want b, ErrStaleData", l, err)
+	}
+	m.RemoveServer("1", "b")
+	if _, err := m.GetServer(0, 0, "1"); err != ErrStaleData {
+		t.Errorf("GetServer after RemoveServer: err = %v, want ErrStaleData", err)
+	}
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "c", Lat: 0, Lon: 0})
+	if l, err := m.GetServer(0, 0, "1"); l != "c" || err != nil {
+		t.Errorf("GetServer after AddServer = %q, %v", l, err)
+	}
+}
+
+func TestExpireEvery(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10), Lease(time.Millisecond))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	stop := m.ExpireEvery(time.Millisecond)
+	defer stop()
+	defer stop() // a second call must not panic
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.Servers("1")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("ExpireEvery did not remove the expired server")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
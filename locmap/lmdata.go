@@ -4,6 +4,10 @@
 
 package locmap
 
+import (
+	"sort"
+)
+
 // Data has the necessary fields needed for adding information to the locationMap
 type Data struct {
 	Status     bool
@@ -11,4 +15,27 @@ type Data struct {
 	ServerId   string
 	Lat        float64
 	Lon        float64
+	Weight     float64 // relative share of clients for WeightedNearest, 0 counts as 1
+	Capacity   float64 // load the server can take, 0 if unknown
+	Load       float64 // current load, in the same unit as Capacity
+	Country    string  // ISO 3166-1 alpha-2 code of the server location
+	Region     string  // region code as in geo.Loc
+	ASN        int64   // AS number of the server network, 0 if unknown
+}
+
+// A Candidate is a server and its distance in km to a location.
+type Candidate struct {
+	Data
+	Dist float64
+}
+
+// sortCandidates orders candidates by distance and then by ServerId, so that
+// equidistant servers are returned in the same order every time.
+func sortCandidates(cs []Candidate) {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Dist != cs[j].Dist {
+			return cs[i].Dist < cs[j].Dist
+		}
+		return cs[i].ServerId < cs[j].ServerId
+	})
 }
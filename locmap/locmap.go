@@ -5,13 +5,13 @@
 // The locmap package provides a data structure that returns the
 // serverId of the closest server for a given geolocation. It can
 // handler mutiple readers and one writter.
-//
 package locmap
 
 import (
 	"container/list"
 	"errors"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -23,11 +23,62 @@ type location struct {
 	distMap map[string]float64 // ResourceId --> distance to closest server
 }
 
+// A LocationMap divides the globe into a grid of cells and keeps the closest
+// server of every resource for each cell, so that GetServer is a lookup.  The
+// cells are 1 degree wide unless the Resolution option is given.  The cell a
+// location falls in is found by truncating its coordinates, so the answer is
+// the closest server to the south west corner of the cell, which may not be
+// the closest server to the location.  For resources given to the Exact
+// option the closest server is computed at query time instead.
+//
+// The memory used grows with the number of cells and the number of resources.
+// With one resource the grid takes about 40MB at 1 degree (65,341 cells),
+// 640MB at 0.25 degrees (1,038,961 cells) and 4GB at 0.1 degrees (6,485,401
+// cells).  Adding a server only computes the distance to the cells of each
+// row that are no farther from it than the farthest cell of the row is from
+// its closest server, and only the cells whose closest server changes are
+// copied.  The first server of a resource still visits every cell.
 type LocationMap struct {
-	mapp    [][]*location
-	rwmutex *sync.RWMutex
-	mutex   *sync.Mutex
-	dataExp time.Time
+	mapp     [][]*location
+	res      float64
+	rows     int
+	cols     int
+	exact    map[string]bool
+	servers  map[string]map[string]Data // ResourceId --> ServerId --> registered server
+	policies map[string]Policy          // ResourceId --> selection policy
+	lease    time.Duration
+	maxAge   time.Duration
+	now      func() time.Time
+	expires  map[serverKey]time.Time // end of the lease of registered servers
+	latency  LatencyProvider
+	rowMax   map[string][]float64 // ResourceId --> row --> farthest distance to the closest server, guarded by mutex
+	rwmutex  *sync.RWMutex
+	mutex    *sync.Mutex
+	dataExp  time.Time // when the data becomes older than maxAge
+}
+
+// An Option configures a LocationMap.
+type Option func(*LocationMap)
+
+// Resolution sets the size of the grid cells in degrees.  It must divide 180;
+// other values are ignored and the default of 1 degree is used.
+func Resolution(deg float64) Option {
+	return func(m *LocationMap) {
+		if n := math.Round(maxLat / deg); deg > 0 && n >= 1 && math.Abs(n*deg-maxLat) < 1e-9 {
+			m.res = deg
+		}
+	}
+}
+
+// Exact makes GetServer compute the closest server for the resources at
+// query time instead of using the grid.  This costs a distance computation
+// per online server of the resource on every query.
+func Exact(resourceIds ...string) Option {
+	return func(m *LocationMap) {
+		for _, id := range resourceIds {
+			m.exact[id] = true
+		}
+	}
 }
 
 const (
@@ -43,178 +94,425 @@ var (
 	BadLocation         = errors.New("Geolocation value is out of range")
 )
 
-// NewLocationMap creates a new location map
-func NewLocationMap() *LocationMap {
+var ErrUnknownServer = errors.New("locmap: unknown server")
 
-	c := make([][]*location, maxLat+1)
+// NewLocationMap creates a new location map
+func NewLocationMap(opts ...Option) *LocationMap {
+
+	m := &LocationMap{
+		res:      1,
+		exact:    make(map[string]bool),
+		servers:  make(map[string]map[string]Data),
+		policies: make(map[string]Policy),
+		now:      time.Now,
+		expires:  make(map[serverKey]time.Time),
+		rowMax:   make(map[string][]float64),
+		rwmutex:  &sync.RWMutex{},
+		mutex:    &sync.Mutex{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.dataExp = m.now().Add(m.maxAge)
+	m.rows = int(math.Round(maxLat/m.res)) + 1
+	m.cols = int(math.Round(maxLon/m.res)) + 1
+
+	// Locations are never modified once they are in the grid, so all cells
+	// can start out sharing one.
+	empty := &location{
+		valMap:  make(map[string]string),
+		distMap: make(map[string]float64),
+	}
+	c := make([][]*location, m.rows)
 	for i := range c {
-		c[i] = make([]*location, maxLon+1)
+		c[i] = make([]*location, m.cols)
 		for j := range c[i] {
-			c[i][j] = &location{
-				valMap:  make(map[string]string),
-				distMap: make(map[string]float64),
-			}
+			c[i][j] = empty
 		}
 	}
-	return &LocationMap{
-		mapp:    c,
-		rwmutex: &sync.RWMutex{},
-		mutex:   &sync.Mutex{},
-		dataExp: time.Now(),
-	}
+	m.mapp = c
+	return m
 }
 
-// deepCopy creates a new location map with the contents of another location map
-func (m *LocationMap) deepCopy() *LocationMap {
-	m.rwmutex.RLock()
-	mm := m.mapp
-	m.rwmutex.RUnlock()
+// A grid is a copy-on-write view of the cells of a LocationMap.  Rows and
+// locations are copied the first time they are changed, so readers of the
+// original cells never see a change and an update allocates memory only for
+// the cells it changes.
+type grid struct {
+	mapp     [][]*location
+	cols     int
+	rowCopy  []bool
+	cellCopy map[int]bool // i*cols+j --> location was copied
+}
 
-	c := make([][]*location, maxLat+1)
-	for i := range c {
-		c[i] = make([]*location, maxLon+1)
-		for j := range c[i] {
-			c[i][j] = mm[i][j]
+// newGrid returns a view of the cells.  The caller must hold m.mutex.
+func (m *LocationMap) newGrid() *grid {
+	g := &grid{
+		mapp:     make([][]*location, len(m.mapp)),
+		cols:     m.cols,
+		rowCopy:  make([]bool, len(m.mapp)),
+		cellCopy: make(map[int]bool),
+	}
+	copy(g.mapp, m.mapp)
+	return g
+}
+
+// set records the closest server of a resource for a cell, or removes the
+// resource from the cell if serverId is empty.
+func (g *grid) set(i, j int, resourceId, serverId string, dist float64) {
+	if !g.rowCopy[i] {
+		row := make([]*location, len(g.mapp[i]))
+		copy(row, g.mapp[i])
+		g.mapp[i] = row
+		g.rowCopy[i] = true
+	}
+	l := g.mapp[i][j]
+	if k := i*g.cols + j; !g.cellCopy[k] {
+		nl := &location{
+			valMap:  make(map[string]string, len(l.valMap)+1),
+			distMap: make(map[string]float64, len(l.distMap)+1),
 		}
+		for r, v := range l.valMap {
+			nl.valMap[r] = v
+		}
+		for r, v := range l.distMap {
+			nl.distMap[r] = v
+		}
+		l = nl
+		g.mapp[i][j] = l
+		g.cellCopy[k] = true
 	}
-	return &LocationMap{
-		mapp: c,
+	if serverId == "" {
+		delete(l.valMap, resourceId)
+		delete(l.distMap, resourceId)
+		return
 	}
+	l.valMap[resourceId] = serverId
+	l.distMap[resourceId] = dist
 }
 
-func (m *LocationMap) set(lat, lon int, data *location) *location {
-
-	if data == nil {
-		m.mapp[lat][lon] = &location{
-			valMap:  make(map[string]string),
-			distMap: make(map[string]float64),
-		}
-	} else {
-		m.mapp[lat][lon] = data
+// cell returns the grid cell holding a location.
+func (m *LocationMap) cell(lat, lon float64) (int, int) {
+	// The tolerance keeps points on a grid line, which are not exact in
+	// floating point, in the cell they start.
+	i := int(math.Floor((lat-LoLat)/m.res + 1e-9))
+	j := int(math.Floor((lon-LoLon)/m.res + 1e-9))
+	if i >= m.rows {
+		i = m.rows - 1
+	}
+	if j >= m.cols {
+		j = m.cols - 1
 	}
-	return m.mapp[lat][lon]
+	return i, j
+}
+
+// cellLatLon returns the south west corner of a grid cell.
+func (m *LocationMap) cellLatLon(i, j int) (float64, float64) {
+	return float64(i)*m.res + LoLat, float64(j)*m.res + LoLon
 }
 
 // GetServer returns the serverId of the closest server for a given geolocation and resourceId.
+// If the data is older than the MaxAge option allows the serverId is returned
+// with ErrStaleData.
 func (m *LocationMap) GetServer(lat, lon float64, resourceId string) (string, error) {
 
 	if lat < LoLat || lat > HiLat || lon < LoLon || lon > HiLon {
 		return "", BadLocation
 	}
+	i, j := m.cell(lat, lon)
 	m.rwmutex.RLock()
-	location := m.mapp[int(lat+maxLat/2)][int(lon+maxLon/2)]
-	m.rwmutex.RUnlock()
-	if location == nil {
-		return "", nil
+	defer m.rwmutex.RUnlock()
+	err := m.stale()
+	if m.exact[resourceId] {
+		return m.closest(lat, lon, resourceId), err
+	}
+	return m.mapp[i][j].valMap[resourceId], err
+}
+
+// closest returns the online server of a resource closest to a location.
+func (m *LocationMap) closest(lat, lon float64, resourceId string) string {
+	serverId := ""
+	distMin := math.MaxFloat64
+	for _, d := range m.servers[resourceId] {
+		if !d.Status {
+			continue
+		}
+		if dist := geo.Distance(lat, lon, d.Lat, d.Lon); dist < distMin {
+			serverId = d.ServerId
+			distMin = dist
+		}
 	}
-	return location.valMap[resourceId], nil
+	return serverId
 }
 
-func (m *LocationMap) setServer(lat, lon int, resourceId, serverId string, dist float64) {
+// GetServers returns up to k online servers of a resource ordered by their
+// distance to a location.  The servers are ranked by the distance to the
+// location itself rather than to its grid cell, so the first one may differ
+// from the server GetServer returns for resources not given to Exact.  Like
+// GetServer it reports stale data with ErrStaleData.
+func (m *LocationMap) GetServers(lat, lon float64, resourceId string, k int) ([]Candidate, error) {
 
-	location := m.mapp[lat][lon]
-	if location == nil {
-		location = m.set(lat, lon, nil)
+	if lat < LoLat || lat > HiLat || lon < LoLon || lon > HiLon {
+		return nil, BadLocation
 	}
+	if k <= 0 {
+		return nil, nil
+	}
+	m.rwmutex.RLock()
+	err := m.stale()
+	cs := make([]Candidate, 0, len(m.servers[resourceId]))
+	for _, d := range m.servers[resourceId] {
+		if d.Status {
+			cs = append(cs, Candidate{d, geo.Distance(lat, lon, d.Lat, d.Lon)})
+		}
+	}
+	m.rwmutex.RUnlock()
+	sortCandidates(cs)
+	if len(cs) > k {
+		cs = cs[:k]
+	}
+	return cs, err
+}
 
-	location.valMap[resourceId] = serverId
-	location.distMap[resourceId] = dist
+// Servers returns the registered servers of a resource, online or not,
+// ordered by ServerId.
+func (m *LocationMap) Servers(resourceId string) []Data {
+	m.rwmutex.RLock()
+	ds := make([]Data, 0, len(m.servers[resourceId]))
+	for _, d := range m.servers[resourceId] {
+		ds = append(ds, d)
+	}
+	m.rwmutex.RUnlock()
+	sort.Slice(ds, func(i, j int) bool {
+		return ds[i].ServerId < ds[j].ServerId
+	})
+	return ds
 }
 
-// Update LocationMap. Can have mutiple readers and one writter.
-func (m *LocationMap) Update(e *Data, allEntries *list.List) {
+// AddServer registers a server or replaces a registered server with the
+// same ResourceId and ServerId.  The server is used if its Status is true.
+func (m *LocationMap) AddServer(d Data) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.apply([]update{{d, false}})
+}
 
-	if e == nil {
-		return
+// SetStatus takes a registered server online or offline.
+func (m *LocationMap) SetStatus(resourceId, serverId string, online bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rwmutex.RLock()
+	d, ok := m.servers[resourceId][serverId]
+	m.rwmutex.RUnlock()
+	if !ok {
+		return ErrUnknownServer
 	}
+	d.Status = online
+	m.apply([]update{{d, false}})
+	return nil
+}
 
+// RemoveServer unregisters a server.
+func (m *LocationMap) RemoveServer(resourceId, serverId string) error {
 	m.mutex.Lock()
-	newMap := m.deepCopy() // readers can continue to read from m
-	if e.Status {
-		newMap.addServer(e)
-	} else {
-		newMap.removeServer(e, allEntries)
+	defer m.mutex.Unlock()
+	m.rwmutex.RLock()
+	d, ok := m.servers[resourceId][serverId]
+	m.rwmutex.RUnlock()
+	if !ok {
+		return ErrUnknownServer
 	}
+	m.apply([]update{{d, true}})
+	return nil
+}
 
-	m.rwmutex.Lock()
-	m.mapp = newMap.mapp
-	m.rwmutex.Unlock()
-	m.mutex.Unlock()
+// Update adds, changes or takes offline the server e.
+//
+// Deprecated: use AddServer or SetStatus.  allEntries is ignored, the
+// LocationMap keeps its own registry of servers.
+func (m *LocationMap) Update(e *Data, allEntries *list.List) {
+
+	if e == nil {
+		return
+	}
+	m.AddServer(*e)
 }
 
-// UpdateMulti LocationMap.
+// UpdateMulti applies Update to every entry of updateEntries, which may hold
+// Data or *Data values, copying the grid only once.
+//
+// Deprecated: use AddServer or SetStatus.  allEntries is ignored.
 func (m *LocationMap) UpdateMulti(updateEntries, allEntries *list.List) {
 
-	if updateEntries.Front() == nil {
+	var us []update
+	for e := updateEntries.Front(); e != nil; e = e.Next() {
+		switch d := e.Value.(type) {
+		case Data:
+			us = append(us, update{d, false})
+		case *Data:
+			if d != nil {
+				us = append(us, update{*d, false})
+			}
+		}
+	}
+	if len(us) == 0 {
 		return
 	}
 
 	m.mutex.Lock()
-	newMap := m.deepCopy()
-	for e := updateEntries.Front(); e != nil; e = e.Next() {
-		ee := e.Value.(*Data)
-		if ee.Status {
-			newMap.addServer(ee)
+	defer m.mutex.Unlock()
+	m.apply(us)
+}
+
+// An update is a change to the registry.
+type update struct {
+	d      Data
+	remove bool
+}
+
+// apply changes the registry and the grid.  Readers continue to read the old
+// grid until the new one is complete.  The caller must hold m.mutex.
+func (m *LocationMap) apply(us []update) {
+
+	g := m.newGrid()
+	reported := false
+	for _, u := range us {
+		reported = reported || !u.remove
+		m.rwmutex.Lock()
+		old, ok := m.servers[u.d.ResourceId][u.d.ServerId]
+		if u.remove {
+			delete(m.servers[u.d.ResourceId], u.d.ServerId)
 		} else {
-			newMap.removeServer(ee, allEntries)
+			if m.servers[u.d.ResourceId] == nil {
+				m.servers[u.d.ResourceId] = make(map[string]Data)
+			}
+			m.servers[u.d.ResourceId][u.d.ServerId] = u.d
+		}
+		k := serverKey{u.d.ResourceId, u.d.ServerId}
+		if u.remove {
+			delete(m.expires, k)
+		} else if m.lease > 0 {
+			m.expires[k] = m.now().Add(m.lease)
+		}
+		m.rwmutex.Unlock()
+
+		if m.exact[u.d.ResourceId] {
+			continue // the grid is not used
+		}
+		online := u.d.Status && !u.remove
+		moved := old.Lat != u.d.Lat || old.Lon != u.d.Lon
+		if ok && old.Status && (!online || moved) {
+			m.removeServer(g, &old, m.servers[u.d.ResourceId])
+		}
+		if online && (!ok || !old.Status || moved) {
+			m.addServer(g, &u.d)
 		}
 	}
 
 	m.rwmutex.Lock()
-	m.mapp = newMap.mapp
+	m.mapp = g.mapp
+	if reported {
+		// Removing a server is not news from the servers, so it does not
+		// make the data younger.
+		m.dataExp = m.now().Add(m.maxAge)
+	}
 	m.rwmutex.Unlock()
-	m.mutex.Unlock()
 }
 
-// addServer adds a online server or a new server
-func (m *LocationMap) addServer(e *Data) {
-	for i := 0; i <= maxLat; i++ {
-		for j := 0; j <= maxLon; j++ {
-
-			location := m.mapp[i][j]
-			if location == nil {
-				location = m.set(i, j, nil)
+// addServer makes a server the closest server of the cells it is closer to
+// than their current one.  Along a row the distance to the server grows with
+// the difference in longitude, so each row is scanned west and east from the
+// column of the server until the distance passes the bound of the row.
+func (m *LocationMap) addServer(g *grid, e *Data) {
+	b := m.bounds(e.ResourceId)
+	_, c := m.cell(e.Lat, e.Lon)
+	for i := 0; i < m.rows; i++ {
+		changed := false
+		visit := func(j int) bool {
+			lat, lon := m.cellLatLon(i, j)
+			d := geo.Distance(lat, lon, e.Lat, e.Lon)
+			if d > b[i] {
+				return false
 			}
-
-			distMap := location.distMap
-			currDist, ok := distMap[e.ResourceId]
-			if !ok {
-				currDist = math.MaxFloat64
+			if cur, ok := g.mapp[i][j].distMap[e.ResourceId]; !ok || d < cur {
+				g.set(i, j, e.ResourceId, e.ServerId, d)
+				changed = true
+			}
+			return true
+		}
+		// Each direction covers half of the 2*rows-1 columns.
+		for k := 0; k < m.rows; k++ {
+			if !visit((c - k + m.cols) % m.cols) {
+				break
 			}
-			newDist := geo.Distance(float64(i-maxLat/2), float64(j-maxLon/2), e.Lat, e.Lon)
-			if newDist < currDist {
-				m.setServer(i, j, e.ResourceId, e.ServerId, newDist)
+		}
+		for k := 1; k < m.rows; k++ {
+			if !visit((c + k) % m.cols) {
+				break
 			}
 		}
+		if changed || math.IsInf(b[i], 1) {
+			b[i] = rowBound(g, i, e.ResourceId)
+		}
 	}
 }
 
-// removeServer removes and if possible replaces an offline or retired server
-func (m *LocationMap) removeServer(e *Data, allEntries *list.List) {
-	for i := 0; i <= maxLat; i++ {
-		for j := 0; j <= maxLon; j++ {
+// bounds returns the largest distance from a cell of each row to the closest
+// server of a resource.  The caller must hold m.mutex.
+func (m *LocationMap) bounds(resourceId string) []float64 {
+	b := m.rowMax[resourceId]
+	if b == nil {
+		b = make([]float64, m.rows)
+		for i := range b {
+			b[i] = math.Inf(1)
+		}
+		m.rowMax[resourceId] = b
+	}
+	return b
+}
 
-			location := m.mapp[i][j]
-			if location == nil {
-				location = m.set(i, j, nil)
-			}
+// rowBound returns the largest distance from a cell of row i to the closest
+// server of a resource, or +Inf if a cell has none.
+func rowBound(g *grid, i int, resourceId string) float64 {
+	b := 0.0
+	for _, l := range g.mapp[i] {
+		d, ok := l.distMap[resourceId]
+		if !ok {
+			return math.Inf(1)
+		}
+		b = math.Max(b, d)
+	}
+	return b
+}
 
-			valMap := location.valMap
-			if valMap[e.ResourceId] == e.ServerId {
-				serverId := ""
-				distMin := math.MaxFloat64
-				for f := allEntries.Front(); f != nil; f = f.Next() {
-					ff := f.Value.(Data)
-					if ff.ResourceId == e.ResourceId && ff.Status {
-						newDist := geo.Distance(float64(i-maxLat/2), float64(j-maxLon/2), ff.Lat, ff.Lon)
-						if newDist < distMin {
-							serverId = ff.ServerId
-							distMin = newDist
-						}
+// removeServer replaces an offline or retired server in the cells it is the
+// closest server of with the closest online server of the registry.
+func (m *LocationMap) removeServer(g *grid, e *Data, servers map[string]Data) {
+	b := m.bounds(e.ResourceId)
+	for i := 0; i < m.rows; i++ {
+		changed := false
+		for j := 0; j < m.cols; j++ {
+
+			if g.mapp[i][j].valMap[e.ResourceId] != e.ServerId {
+				continue
+			}
+			serverId := ""
+			distMin := math.MaxFloat64
+			lat, lon := m.cellLatLon(i, j)
+			for _, ff := range servers {
+				if ff.Status {
+					newDist := geo.Distance(lat, lon, ff.Lat, ff.Lon)
+					if newDist < distMin {
+						serverId = ff.ServerId
+						distMin = newDist
 					}
 				}
-				m.setServer(i, j, e.ResourceId, serverId, distMin) //remove/replace
 			}
+			g.set(i, j, e.ResourceId, serverId, distMin) //remove/replace
+			changed = true
+		}
+		if changed {
+			b[i] = rowBound(g, i, e.ResourceId)
 		}
 	}
 }
@@ -8,10 +8,13 @@ import (
 	"container/list"
 	"fmt"
 	"math"
+	"math/rand"
 	"runtime"
 	"strconv"
 	"strings"
 	"testing"
+
+	"code.google.com/p/iptrie/geo"
 )
 
 func getMemStats(m *runtime.MemStats) uint64 {
@@ -168,3 +171,312 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("Update: change location check")
 	}
 }
+
+func TestResolution(t *testing.T) {
+
+	for _, res := range []float64{1, 0.5, 0.25} {
+		m := NewLocationMap(Resolution(res))
+		if len(m.mapp) != int(maxLat/res)+1 || len(m.mapp[0]) != int(maxLon/res)+1 {
+			t.Errorf("Resolution(%v): grid is %dx%d", res, len(m.mapp), len(m.mapp[0]))
+		}
+		_, err := m.GetServer(90, 180, "1")
+		if err != nil {
+			t.Errorf("Resolution(%v): GetServer(90, 180): %v", res, err)
+		}
+	}
+
+	// Values that do not divide 180 fall back to 1 degree.
+	for _, res := range []float64{0, -1, 0.7, 7, 181, math.NaN(), math.Inf(1)} {
+		m := NewLocationMap(Resolution(res))
+		if m.res != 1 || len(m.mapp) != maxLat+1 || len(m.mapp[0]) != maxLon+1 {
+			t.Errorf("Resolution(%v): res %v, grid is %dx%d", res, m.res, len(m.mapp), len(m.mapp[0]))
+		}
+	}
+	if m := NewLocationMap(Resolution(0.1)); m.res != 0.1 {
+		t.Errorf("Resolution(0.1) = %v", m.res)
+	}
+	if i, j := NewLocationMap(Resolution(0.1)).cell(-89.9, -179.7); i != 1 || j != 3 {
+		t.Errorf("Resolution(0.1): cell(-89.9, -179.7) = %d, %d", i, j)
+	}
+
+	// Two servers 0.5 degrees apart share a cell on the 1 degree grid.
+	servers := []Data{
+		{Status: true, ResourceId: "1", ServerId: "west", Lat: 10, Lon: 20},
+		{Status: true, ResourceId: "1", ServerId: "east", Lat: 10, Lon: 20.5},
+	}
+	coarse := NewLocationMap()
+	fine := NewLocationMap(Resolution(0.25))
+	for i := range servers {
+		coarse.Update(&servers[i], nil)
+		fine.Update(&servers[i], nil)
+	}
+	if l, _ := coarse.GetServer(10.1, 20.6, "1"); l != "west" {
+		t.Errorf("Resolution(1): GetServer = %q, want west", l)
+	}
+	if l, _ := fine.GetServer(10.1, 20.6, "1"); l != "east" {
+		t.Errorf("Resolution(0.25): GetServer = %q, want east", l)
+	}
+}
+
+func TestExact(t *testing.T) {
+
+	m := NewLocationMap(Exact("1"))
+	servers := []Data{
+		{Status: true, ResourceId: "1", ServerId: "west", Lat: 10, Lon: 20.1},
+		{Status: true, ResourceId: "1", ServerId: "east", Lat: 10, Lon: 20.8},
+		{Status: true, ResourceId: "2", ServerId: "west", Lat: 10, Lon: 20.1},
+		{Status: true, ResourceId: "2", ServerId: "east", Lat: 10, Lon: 20.8},
+	}
+	for i := range servers {
+		m.Update(&servers[i], nil)
+	}
+	if l, _ := m.GetServer(10.5, 20.7, "1"); l != "east" {
+		t.Errorf("Exact: GetServer = %q, want east", l)
+	}
+	if l, _ := m.GetServer(10.5, 20.7, "2"); l != "west" {
+		t.Errorf("grid: GetServer = %q, want west", l)
+	}
+
+	allEntries := list.New()
+	for _, e := range servers {
+		if e.ServerId != "east" || e.ResourceId != "1" {
+			allEntries.PushBack(e)
+		}
+	}
+	servers[1].Status = false
+	m.Update(&servers[1], allEntries)
+	if l, _ := m.GetServer(10.5, 20.7, "1"); l != "west" {
+		t.Errorf("Exact: GetServer after removal = %q, want west", l)
+	}
+}
+
+func TestGetServers(t *testing.T) {
+
+	m := NewLocationMap()
+	if _, err := m.GetServers(0, 400, "1", 3); err != BadLocation {
+		t.Errorf("GetServers: boundary check failed")
+	}
+	servers := []Data{
+		{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 1},
+		{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 3},
+		{Status: true, ResourceId: "1", ServerId: "c", Lat: 0, Lon: 2},
+		{Status: true, ResourceId: "2", ServerId: "d", Lat: 0, Lon: 0},
+	}
+	allEntries := list.New()
+	for i := range servers {
+		m.Update(&servers[i], nil)
+		allEntries.PushBack(servers[i])
+	}
+
+	cs, _ := m.GetServers(0, 0, "1", 2)
+	if len(cs) != 2 || cs[0].ServerId != "a" || cs[1].ServerId != "c" {
+		t.Fatalf("GetServers = %v, want a, c", cs)
+	}
+	if d := geo.Distance(0, 0, 0, 1); cs[0].Dist != d {
+		t.Errorf("GetServers: distance %v, want %v", cs[0].Dist, d)
+	}
+	if cs, _ = m.GetServers(0, 0, "1", 10); len(cs) != 3 {
+		t.Errorf("GetServers: got %d servers, want 3", len(cs))
+	}
+	for _, k := range []int{0, -1} {
+		if cs, err := m.GetServers(0, 0, "1", k); len(cs) != 0 || err != nil {
+			t.Errorf("GetServers(k=%d) = %v, %v", k, cs, err)
+		}
+	}
+
+	allEntries.Remove(allEntries.Front())
+	servers[0].Status = false
+	m.Update(&servers[0], allEntries)
+	cs, _ = m.GetServers(0, 0, "1", 10)
+	if len(cs) != 2 || cs[0].ServerId != "c" || cs[1].ServerId != "b" {
+		t.Errorf("GetServers after removal = %v, want c, b", cs)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 60})
+	m.AddServer(Data{Status: false, ResourceId: "1", ServerId: "c", Lat: 0, Lon: 40})
+
+	ds := m.Servers("1")
+	if len(ds) != 3 || ds[0].ServerId != "a" || ds[2].ServerId != "c" || ds[2].Status {
+		t.Fatalf("Servers = %v", ds)
+	}
+	if l, _ := m.GetServer(0, 40, "1"); l != "b" {
+		t.Errorf("GetServer with c offline = %q, want b", l)
+	}
+
+	if err := m.SetStatus("1", "c", true); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := m.GetServer(0, 40, "1"); l != "c" {
+		t.Errorf("GetServer with c online = %q, want c", l)
+	}
+	if err := m.SetStatus("1", "c", false); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := m.GetServer(0, 40, "1"); l != "b" {
+		t.Errorf("GetServer with c offline again = %q, want b", l)
+	}
+
+	// Moving a server updates the cells it was and is closest to.
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 100})
+	if l, _ := m.GetServer(0, 0, "1"); l != "b" {
+		t.Errorf("GetServer after moving a = %q, want b", l)
+	}
+	if l, _ := m.GetServer(0, 110, "1"); l != "a" {
+		t.Errorf("GetServer after moving a = %q, want a", l)
+	}
+
+	if err := m.RemoveServer("1", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := m.GetServer(0, 0, "1"); l != "a" {
+		t.Errorf("GetServer after removing b = %q, want a", l)
+	}
+	if len(m.Servers("1")) != 2 {
+		t.Errorf("Servers after RemoveServer = %v", m.Servers("1"))
+	}
+	if err := m.RemoveServer("1", "b"); err != ErrUnknownServer {
+		t.Errorf("RemoveServer of unknown server: err = %v", err)
+	}
+	if err := m.SetStatus("2", "a", true); err != ErrUnknownServer {
+		t.Errorf("SetStatus of unknown server: err = %v", err)
+	}
+
+	if err := m.RemoveServer("1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := m.GetServer(0, 0, "1"); l != "" {
+		t.Errorf("GetServer without servers = %q", l)
+	}
+}
+
+func TestUpdateMultiMixed(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10))
+	updates := list.New()
+	updates.PushBack(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	updates.PushBack(&Data{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 60})
+	m.UpdateMulti(updates, nil)
+	if l, _ := m.GetServer(0, 50, "1"); l != "b" {
+		t.Errorf("GetServer = %q, want b", l)
+	}
+
+	updates.Init()
+	updates.PushBack(&Data{Status: false, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 60})
+	m.UpdateMulti(updates, nil)
+	if l, _ := m.GetServer(0, 50, "1"); l != "a" {
+		t.Errorf("GetServer after b went offline = %q, want a", l)
+	}
+}
+
+func TestCopyOnWrite(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0})
+	before := m.mapp
+	cell := before[9][18]
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 170})
+	if cell.valMap["1"] != "a" {
+		t.Errorf("Update changed a published location")
+	}
+	if m.mapp[9][18] != cell {
+		t.Errorf("Update copied a cell it did not change")
+	}
+	if m.mapp[9][35] == before[9][35] || m.mapp[9][35].valMap["1"] != "b" {
+		t.Errorf("Update did not copy a cell it changed")
+	}
+	if before[9][35].valMap["1"] != "a" {
+		t.Errorf("Update changed a published row")
+	}
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+
+	m := NewLocationMap(Resolution(10), Exact("2"))
+	for i := 0; i < 4; i++ {
+		for _, r := range []string{"1", "2"} {
+			m.AddServer(Data{Status: true, ResourceId: r, ServerId: strconv.Itoa(i), Lat: float64(20 * i), Lon: float64(40 * i)})
+		}
+	}
+	done := make(chan bool)
+	for g := 0; g < 4; g++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, r := range []string{"1", "2"} {
+					if l, _ := m.GetServer(10, 10, r); l == "" {
+						t.Errorf("GetServer(%s) found no server", r)
+					}
+					m.GetServers(10, 10, r, 2)
+					m.GetServerFor(10, 10, r, "k")
+				}
+				m.Servers("1")
+			}
+		}()
+	}
+	for n := 0; n < 100; n++ {
+		// Server 0 never goes offline, so there is always a server.
+		id := strconv.Itoa(1 + n%3)
+		m.SetStatus("1", id, n%2 == 0)
+		m.SetStatus("2", id, n%2 == 0)
+		m.SetLoad("1", id, float64(n))
+	}
+	close(done)
+}
+
+func TestIncrementalGrid(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	for _, res := range []float64{10, 1} {
+		m := NewLocationMap(Resolution(res))
+		for n := 0; n < 200; n++ {
+			id := strconv.Itoa(r.Intn(30))
+			switch r.Intn(4) {
+			case 0:
+				m.SetStatus("1", id, false)
+			case 1:
+				m.RemoveServer("1", id)
+			default:
+				m.AddServer(Data{Status: true, ResourceId: "1", ServerId: id, Lat: r.Float64()*180 - 90, Lon: r.Float64()*360 - 180})
+			}
+			if n%20 != 19 {
+				continue
+			}
+			for i := 0; i < m.rows; i++ {
+				for j := 0; j < m.cols; j++ {
+					lat, lon := m.cellLatLon(i, j)
+					want, ok := math.MaxFloat64, false
+					for _, d := range m.Servers("1") {
+						if d.Status {
+							want, ok = math.Min(want, geo.Distance(lat, lon, d.Lat, d.Lon)), true
+						}
+					}
+					got, has := m.mapp[i][j].distMap["1"]
+					if has != ok || has && math.Abs(got-want) > 1e-9 {
+						t.Fatalf("Resolution(%v) step %d: cell %d,%d has %v %v, want %v %v", res, n, i, j, got, has, want, ok)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkFlap(b *testing.B) {
+	m := NewLocationMap()
+	for i := 0; i < 20; i++ {
+		m.AddServer(Data{Status: true, ResourceId: "1", ServerId: strconv.Itoa(i), Lat: float64(8*i - 80), Lon: float64(17*i - 170)})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.SetStatus("1", "7", i%2 == 1)
+	}
+}
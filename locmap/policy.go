@@ -0,0 +1,152 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// A PolicyKind selects how GetServerFor picks a server among the candidates
+// of a resource.
+type PolicyKind int
+
+const (
+	// Nearest picks the server GetServer returns.
+	Nearest PolicyKind = iota
+	// WeightedNearest spreads clients over the servers within Radius km of
+	// the location in proportion to their Weight.
+	WeightedNearest
+	// LeastLoaded picks the server within Radius km of the location with the
+	// lowest Load relative to its Capacity.  Servers at capacity are skipped.
+	LeastLoaded
+	// ConsistentHash picks among the servers no more than Tolerance km
+	// further away than the nearest one by hashing the key, so a key keeps
+	// its server as long as that server is online.
+	ConsistentHash
+)
+
+// A Policy controls the server selection of a resource.  The nearest server is
+// used whenever no server qualifies.
+type Policy struct {
+	Kind      PolicyKind
+	Radius    float64 // km, for WeightedNearest and LeastLoaded
+	Tolerance float64 // km, for ConsistentHash
+}
+
+// SetPolicy sets the selection policy of a resource.  Resources without a
+// policy use Nearest.
+func (m *LocationMap) SetPolicy(resourceId string, p Policy) {
+	m.rwmutex.Lock()
+	m.policies[resourceId] = p
+	m.rwmutex.Unlock()
+}
+
+func (m *LocationMap) policy(resourceId string) Policy {
+	m.rwmutex.RLock()
+	defer m.rwmutex.RUnlock()
+	return m.policies[resourceId]
+}
+
+// SetLoad updates the load of an online server without the cost of Update.
+// Unknown servers are ignored.
+func (m *LocationMap) SetLoad(resourceId, serverId string, load float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rwmutex.Lock()
+	if d, ok := m.servers[resourceId][serverId]; ok {
+		d.Load = load
+		m.servers[resourceId][serverId] = d
+	}
+	m.rwmutex.Unlock()
+}
+
+// GetServerFor returns the serverId of the server the policy of the resource
+// picks for a location.  Like GetServer it reports stale data with
+// ErrStaleData.  The key, usually the client address or the requested
+// object, makes the choice of WeightedNearest and ConsistentHash stable.
+func (m *LocationMap) GetServerFor(lat, lon float64, resourceId, key string) (string, error) {
+
+	p := m.policy(resourceId)
+	if p.Kind == Nearest {
+		return m.GetServer(lat, lon, resourceId)
+	}
+	cs, err := m.GetServers(lat, lon, resourceId, math.MaxInt32)
+	if err != nil && err != ErrStaleData || len(cs) == 0 {
+		return "", err
+	}
+	return p.pick(cs, key).ServerId, err
+}
+
+// pick selects a server from candidates ordered by distance.
+func (p Policy) pick(cs []Candidate, key string) Candidate {
+	switch p.Kind {
+	case WeightedNearest:
+		best, bestScore := cs[0], math.Inf(-1)
+		for _, c := range within(cs, p.Radius) {
+			w := c.Weight
+			if w <= 0 {
+				w = 1
+			}
+			// Weighted rendezvous hashing: the key goes to server i with
+			// probability w_i / sum(w).
+			if score := -w / math.Log(hashUnit(key, c.ServerId)); score > bestScore {
+				best, bestScore = c, score
+			}
+		}
+		return best
+	case LeastLoaded:
+		best, bestUse := cs[0], math.Inf(1)
+		for _, c := range within(cs, p.Radius) {
+			use := c.Load
+			if c.Capacity > 0 {
+				if c.Load >= c.Capacity {
+					continue
+				}
+				use = c.Load / c.Capacity
+			}
+			if use < bestUse {
+				best, bestUse = c, use
+			}
+		}
+		return best
+	case ConsistentHash:
+		best, bestHash := cs[0], -1.0
+		for _, c := range cs {
+			if c.Dist > cs[0].Dist+p.Tolerance {
+				break
+			}
+			if h := hashUnit(key, c.ServerId); h > bestHash {
+				best, bestHash = c, h
+			}
+		}
+		return best
+	}
+	return cs[0]
+}
+
+// within returns the candidates at most radius km away.
+func within(cs []Candidate, radius float64) []Candidate {
+	n := 0
+	for n < len(cs) && cs[n].Dist <= radius {
+		n++
+	}
+	return cs[:n]
+}
+
+// hashUnit hashes a key and a server to a number in (0, 1).
+func hashUnit(key, serverId string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(serverId))
+	// FNV leaves the high bits of keys differing in their last bytes alike,
+	// so they are mixed with the finalizer of SplitMix64.
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,113 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"fmt"
+	"testing"
+)
+
+func policyMap(servers []Data) *LocationMap {
+	m := NewLocationMap(Resolution(10))
+	for _, d := range servers {
+		m.AddServer(d)
+	}
+	return m
+}
+
+func TestPolicyNearest(t *testing.T) {
+
+	m := policyMap([]Data{
+		{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0},
+		{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 50},
+	})
+	want, _ := m.GetServer(0, 40, "1")
+	if l, _ := m.GetServerFor(0, 40, "1", "k"); l != want {
+		t.Errorf("GetServerFor = %q, want %q", l, want)
+	}
+	if _, err := m.GetServerFor(0, 400, "1", "k"); err != BadLocation {
+		t.Errorf("GetServerFor: boundary check failed")
+	}
+}
+
+func TestPolicyWeightedNearest(t *testing.T) {
+
+	m := policyMap([]Data{
+		{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 0, Weight: 1},
+		{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: 0.1, Weight: 3},
+		{Status: true, ResourceId: "1", ServerId: "far", Lat: 40, Lon: 40, Weight: 100},
+	})
+	m.SetPolicy("1", Policy{Kind: WeightedNearest, Radius: 100})
+	n := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		l, _ := m.GetServerFor(0, 0, "1", fmt.Sprint(i))
+		n[l]++
+	}
+	if n["far"] != 0 {
+		t.Errorf("WeightedNearest picked a server outside the radius %d times", n["far"])
+	}
+	if n["b"] < 2700 || n["b"] > 3300 {
+		t.Errorf("WeightedNearest: b got %d of 4000 clients, want about 3000", n["b"])
+	}
+	a, _ := m.GetServerFor(0, 0, "1", "client")
+	if b, _ := m.GetServerFor(0, 0, "1", "client"); a != b {
+		t.Errorf("WeightedNearest is not stable: %q, %q", a, b)
+	}
+}
+
+func TestPolicyLeastLoaded(t *testing.T) {
+
+	m := policyMap([]Data{
+		{Status: true, ResourceId: "1", ServerId: "near", Lat: 0, Lon: 0, Capacity: 100, Load: 100},
+		{Status: true, ResourceId: "1", ServerId: "busy", Lat: 0, Lon: 0.2, Capacity: 100, Load: 60},
+		{Status: true, ResourceId: "1", ServerId: "big", Lat: 0, Lon: 0.4, Capacity: 1000, Load: 300},
+		{Status: true, ResourceId: "1", ServerId: "idle", Lat: 30, Lon: 30, Capacity: 100},
+	})
+	m.SetPolicy("1", Policy{Kind: LeastLoaded, Radius: 100})
+	if l, _ := m.GetServerFor(0, 0, "1", ""); l != "big" {
+		t.Errorf("LeastLoaded = %q, want big", l)
+	}
+	m.SetLoad("1", "big", 900)
+	if l, _ := m.GetServerFor(0, 0, "1", ""); l != "busy" {
+		t.Errorf("LeastLoaded after SetLoad = %q, want busy", l)
+	}
+	m.SetLoad("1", "busy", 100)
+	m.SetLoad("1", "big", 1000)
+	if l, _ := m.GetServerFor(0, 0, "1", ""); l != "near" {
+		t.Errorf("LeastLoaded with all servers full = %q, want near", l)
+	}
+}
+
+func TestPolicyConsistentHash(t *testing.T) {
+
+	servers := []Data{
+		{Status: true, ResourceId: "1", ServerId: "a", Lat: 0, Lon: 1},
+		{Status: true, ResourceId: "1", ServerId: "b", Lat: 0, Lon: -1},
+		{Status: true, ResourceId: "1", ServerId: "c", Lat: 1, Lon: 0},
+		{Status: true, ResourceId: "1", ServerId: "far", Lat: 0, Lon: 5},
+	}
+	m := policyMap(servers)
+	m.SetPolicy("1", Policy{Kind: ConsistentHash, Tolerance: 1})
+	before := map[string]string{}
+	n := map[string]int{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprint(i)
+		l, _ := m.GetServerFor(0, 0, "1", key)
+		before[key] = l
+		n[l]++
+	}
+	if n["far"] != 0 || n["a"] == 0 || n["b"] == 0 || n["c"] == 0 {
+		t.Errorf("ConsistentHash spread = %v", n)
+	}
+
+	// Only the keys of a removed server move.
+	m.SetStatus("1", "b", false)
+	for key, old := range before {
+		l, _ := m.GetServerFor(0, 0, "1", key)
+		if old != "b" && l != old {
+			t.Errorf("ConsistentHash: key %s moved from %s to %s", key, old, l)
+		}
+	}
+}
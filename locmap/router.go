@@ -0,0 +1,244 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+
+	"code.google.com/p/iptrie"
+	"code.google.com/p/iptrie/geo"
+)
+
+var (
+	ErrNoServer   = errors.New("locmap: no server for address")
+	ErrPinOverlap = errors.New("locmap: pinned CIDR overlaps another pin")
+)
+
+// A Reason tells how a Router chose a server.
+type Reason int
+
+const (
+	GeoHit          Reason = iota // the address has a city location
+	CountryFallback               // the address only has a country location
+	DefaultServer                 // the address has no usable location or no server is near it
+	PinnedServer                  // the address is in a pinned CIDR
+)
+
+func (r Reason) String() string {
+	switch r {
+	case GeoHit:
+		return "geo hit"
+	case CountryFallback:
+		return "country fallback"
+	case DefaultServer:
+		return "default server"
+	case PinnedServer:
+		return "pinned server"
+	}
+	return "unknown"
+}
+
+// A Decision is the server a Router chose for an address.
+type Decision struct {
+	ServerId string
+	Loc      *geo.Loc // nil if the address has no location
+	Reason   Reason
+}
+
+// A Rule restricts the servers a Router considers for a resource to those
+// matching the client.  Clients without a matching server get the default
+// server, so a restriction is never broken to find a closer server.
+type Rule struct {
+	SameCountry bool // only servers in the country of the client
+	SameRegion  bool // only servers in the country and region of the client
+	PreferASN   bool // servers in the AS of the client, if there are any
+}
+
+// A Router chooses servers for IP addresses by looking up their location in
+// a geo.DB and asking a LocationMap for a server near it, using the policy of
+// the resource.  Addresses without a location, locations out of range and
+// resources without servers get the default server.  Pinned CIDRs take
+// precedence over everything else.
+type Router struct {
+	DB       *geo.DB
+	Map      *LocationMap
+	Default  string            // server for every resource not in Defaults
+	Defaults map[string]string // ResourceId --> default server
+	Rules    map[string]Rule   // ResourceId --> affinity rule
+
+	mutex   sync.RWMutex
+	pins    map[string]*iptrie.IPTrie // ResourceId --> *pin
+	pinNets map[string][]*net.IPNet   // ResourceId --> pinned CIDRs
+}
+
+// A pin keeps its network since an IPTrie range of a single address also
+// matches the addresses after it.
+type pin struct {
+	n        *net.IPNet
+	serverId string
+}
+
+// NewRouter creates a Router without default servers or rules.
+func NewRouter(db *geo.DB, m *LocationMap) *Router {
+	return &Router{
+		DB:       db,
+		Map:      m,
+		Defaults: make(map[string]string),
+		Rules:    make(map[string]Rule),
+	}
+}
+
+// Pin sends every address in cidr to a server of a resource.  Pinning a CIDR
+// again changes its server.  ErrPinOverlap is returned for a CIDR that
+// contains or is contained in another pinned CIDR of the resource, since the
+// pins are kept as ranges in an IPTrie, which cannot hold nested ranges.
+func (r *Router) Pin(cidr, resourceId, serverId string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	s := n.IP.To16()
+	e := make(net.IP, len(s))
+	d := len(s) - len(n.Mask)
+	for i := range s {
+		e[i] = s[i]
+		if i >= d {
+			e[i] |= ^n.Mask[i-d]
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pins == nil {
+		r.pins = make(map[string]*iptrie.IPTrie)
+		r.pinNets = make(map[string][]*net.IPNet)
+	}
+	same := false
+	for _, pn := range r.pinNets[resourceId] {
+		if pn.String() == n.String() {
+			same = true
+		} else if pn.Contains(n.IP) || n.Contains(pn.IP) {
+			return ErrPinOverlap
+		}
+	}
+	t := r.pins[resourceId]
+	if t == nil {
+		t = iptrie.NewIPTrie()
+		r.pins[resourceId] = t
+	}
+	t.AddRangeIp(s, e, &pin{n, serverId})
+	if !same {
+		r.pinNets[resourceId] = append(r.pinNets[resourceId], n)
+	}
+	return nil
+}
+
+func (r *Router) pinned(ip, resourceId string) string {
+	r.mutex.RLock()
+	t := r.pins[resourceId]
+	r.mutex.RUnlock()
+	if t == nil {
+		return ""
+	}
+	p, _ := t.Get(ip).(*pin)
+	if p == nil || !p.n.Contains(net.ParseIP(ip)) {
+		return ""
+	}
+	return p.serverId
+}
+
+// Route chooses a server of a resource for an IP address.  ErrNoServer is
+// returned with the Decision when the default server is needed but there is
+// none, and ErrStaleData when the server was chosen from stale data.
+func (r *Router) Route(ip, resourceId string) (Decision, error) {
+
+	var d Decision
+	res, err := r.DB.Lookup(ip)
+	if err == geo.ErrBadIP {
+		return d, err
+	}
+	d.Loc = res.Loc
+	if d.ServerId = r.pinned(ip, resourceId); d.ServerId != "" {
+		d.Reason = PinnedServer
+		return d, nil
+	}
+	if d.Loc != nil {
+		d.Reason = GeoHit
+		if res.Fallback {
+			d.Reason = CountryFallback
+		}
+		rule, ok := r.Rules[resourceId]
+		if ok || r.Map.latency != nil {
+			d.ServerId, err = r.apply(rule, res, resourceId, ip)
+		} else {
+			d.ServerId, err = r.Map.GetServerFor(d.Loc.Lat, d.Loc.Lon, resourceId, ip)
+		}
+		if (err == nil || err == ErrStaleData) && d.ServerId != "" {
+			return d, err
+		}
+	}
+	return r.fallback(d, resourceId)
+}
+
+// apply picks a server among the servers matching the rule, by RTT if the
+// LocationMap has a Latency option and by the policy of the resource
+// otherwise.  Stale data is reported with ErrStaleData.
+func (r *Router) apply(rule Rule, res geo.Result, resourceId, ip string) (string, error) {
+	loc := res.Loc
+	cs, err := r.Map.GetServers(loc.Lat, loc.Lon, resourceId, math.MaxInt32)
+	if err != nil && err != ErrStaleData {
+		return "", err
+	}
+	match := cs[:0]
+	for _, c := range cs {
+		if (rule.SameCountry || rule.SameRegion) && c.Country != loc.CountryCode {
+			continue
+		}
+		if rule.SameRegion && c.Region != loc.Region {
+			continue
+		}
+		match = append(match, c)
+	}
+	if rule.PreferASN && res.AS != nil {
+		var same []Candidate
+		for _, c := range match {
+			if c.ASN == res.AS.Num {
+				same = append(same, c)
+			}
+		}
+		if len(same) > 0 {
+			match = same
+		}
+	}
+	if len(match) == 0 {
+		return "", err
+	}
+	c := Client{
+		IP:      ip,
+		Country: loc.CountryCode,
+		Region:  loc.Region,
+		Lat:     loc.Lat,
+		Lon:     loc.Lon,
+	}
+	if res.AS != nil {
+		c.ASN = res.AS.Num
+	}
+	return r.Map.choose(c, match, resourceId, ip).ServerId, err
+}
+
+func (r *Router) fallback(d Decision, resourceId string) (Decision, error) {
+	d.Reason = DefaultServer
+	d.ServerId = r.Defaults[resourceId]
+	if d.ServerId == "" {
+		d.ServerId = r.Default
+	}
+	if d.ServerId == "" {
+		return d, ErrNoServer
+	}
+	return d, nil
+}
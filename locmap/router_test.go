@@ -0,0 +1,232 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/iptrie"
+	"code.google.com/p/iptrie/geo"
+)
+
+func testRouter(t *testing.T) *Router {
+	db, err := geo.OpenDB("../geo/testdata/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewLocationMap(Resolution(10))
+	servers := []Data{
+		{Status: true, ResourceId: "1", ServerId: "sjc", Lat: 37.3, Lon: -121.9},
+		{Status: true, ResourceId: "1", ServerId: "yyz", Lat: 43.7, Lon: -79.6},
+		{Status: true, ResourceId: "1", ServerId: "syd", Lat: -33.9, Lon: 151.2},
+	}
+	for i := range servers {
+		m.Update(&servers[i], nil)
+	}
+	return NewRouter(db, m)
+}
+
+func TestRoute(t *testing.T) {
+
+	r := testRouter(t)
+	r.Default = "any"
+	r.Defaults["2"] = "two"
+	var tests = []struct {
+		ip, resourceId string
+		serverId       string
+		reason         Reason
+		hasLoc         bool
+	}{
+		{"8.8.8.8", "1", "sjc", GeoHit, true},
+		{"1.0.0.1", "1", "syd", GeoHit, true},
+		{"67.202.1.1", "1", "yyz", GeoHit, true},
+		{"24.48.0.1", "1", "yyz", CountryFallback, true},
+		{"127.0.0.1", "1", "any", DefaultServer, false},
+		{"8.8.8.8", "2", "two", DefaultServer, true},
+		{"8.8.8.8", "3", "any", DefaultServer, true},
+	}
+	for _, tt := range tests {
+		d, err := r.Route(tt.ip, tt.resourceId)
+		if err != nil {
+			t.Errorf("Route(%s, %s): %v", tt.ip, tt.resourceId, err)
+			continue
+		}
+		if d.ServerId != tt.serverId || d.Reason != tt.reason || (d.Loc != nil) != tt.hasLoc {
+			t.Errorf("Route(%s, %s) = %s, %v, %v", tt.ip, tt.resourceId, d.ServerId, d.Reason, d.Loc)
+		}
+	}
+
+	if _, err := r.Route("bogus", "1"); err != geo.ErrBadIP {
+		t.Errorf("Route(bogus): err = %v, want ErrBadIP", err)
+	}
+	r.Default = ""
+	if d, err := r.Route("127.0.0.1", "1"); err != ErrNoServer || d.Reason != DefaultServer {
+		t.Errorf("Route without default = %v, %v", d, err)
+	}
+}
+
+func TestRouteBadLocation(t *testing.T) {
+
+	db := geo.NewDB()
+	db.City.AddRangeIp(iptrie.Uint32ToIPv4(0x0a000000), iptrie.Uint32ToIPv4(0x0affffff), &geo.Loc{Lat: 95, Lon: 0})
+	m := NewLocationMap(Resolution(10))
+	r := NewRouter(db, m)
+	r.Default = "any"
+	d, err := r.Route("10.1.2.3", "1")
+	if err != nil || d.ServerId != "any" || d.Reason != DefaultServer || d.Loc == nil {
+		t.Errorf("Route with a bad location = %v, %v", d, err)
+	}
+}
+
+func TestRouteRules(t *testing.T) {
+
+	db, err := geo.OpenDB("../geo/testdata/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewLocationMap(Resolution(10), Exact("none"))
+	servers := []Data{
+		{ServerId: "buf", Lat: 42.9, Lon: -78.9, Country: "US", Region: "NY"},
+		{ServerId: "yul", Lat: 45.5, Lon: -73.6, Country: "CA", Region: "QC"},
+		{ServerId: "yow", Lat: 45.4, Lon: -75.7, Country: "CA", Region: "ON"},
+		{ServerId: "yvr", Lat: 49.3, Lon: -123.1, Country: "CA", Region: "BC", ASN: 577},
+	}
+	for _, id := range []string{"none", "country", "region", "asn"} {
+		for _, s := range servers {
+			s.Status, s.ResourceId = true, id
+			m.Update(&s, nil)
+		}
+	}
+	r := NewRouter(db, m)
+	r.Default = "any"
+	r.Rules["country"] = Rule{SameCountry: true}
+	r.Rules["region"] = Rule{SameRegion: true}
+	r.Rules["asn"] = Rule{SameCountry: true, PreferASN: true}
+
+	var tests = []struct {
+		ip, resourceId string
+		serverId       string
+		reason         Reason
+	}{
+		{"67.202.1.1", "none", "buf", GeoHit},
+		{"67.202.1.1", "country", "yow", GeoHit},
+		{"67.202.1.1", "region", "yow", GeoHit},
+		{"67.202.1.1", "asn", "yvr", GeoHit},
+		{"8.8.8.8", "none", "yvr", GeoHit},
+		{"8.8.8.8", "country", "buf", GeoHit},
+		{"8.8.8.8", "region", "any", DefaultServer},
+		{"8.8.8.8", "asn", "buf", GeoHit},
+		{"24.48.0.1", "asn", "yow", CountryFallback},
+	}
+	for _, tt := range tests {
+		d, err := r.Route(tt.ip, tt.resourceId)
+		if err != nil || d.ServerId != tt.serverId || d.Reason != tt.reason {
+			t.Errorf("Route(%s, %s) = %s, %v, %v; want %s, %v", tt.ip, tt.resourceId, d.ServerId, d.Reason, err, tt.serverId, tt.reason)
+		}
+	}
+}
+
+func TestRouteStale(t *testing.T) {
+
+	db, err := geo.OpenDB("../geo/testdata/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewLatencyMatrix()
+	x.SetRegion("US", "", "yyz", 10*time.Millisecond)
+	c := &fakeClock{t: time.Unix(0, 0)}
+	for _, opt := range []Option{nil, Latency(x)} {
+		opts := []Option{Resolution(10), MaxAge(time.Minute), Clock(c.Now)}
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+		m := NewLocationMap(opts...)
+		m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "sjc", Lat: 37.3, Lon: -121.9, Country: "US"})
+		m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "yyz", Lat: 43.7, Lon: -79.6, Country: "CA"})
+		r := NewRouter(db, m)
+		r.Rules["1"] = Rule{}
+		want := "sjc"
+		if opt != nil {
+			want = "yyz"
+		}
+		if d, err := r.Route("8.8.8.8", "1"); d.ServerId != want || err != nil {
+			t.Errorf("Route = %q, %v", d.ServerId, err)
+		}
+		c.Advance(time.Hour)
+		if _, err := m.GetServers(0, 0, "1", 1); err != ErrStaleData {
+			t.Errorf("GetServers with stale data: err = %v", err)
+		}
+		d, err := r.Route("8.8.8.8", "1")
+		if d.ServerId != want || d.Reason != GeoHit || err != ErrStaleData {
+			t.Errorf("Route with stale data = %q, %v, %v", d.ServerId, d.Reason, err)
+		}
+		delete(r.Rules, "1")
+		if d, err = r.Route("8.8.8.8", "1"); d.ServerId != want || err != ErrStaleData {
+			t.Errorf("Route without a rule with stale data = %q, %v", d.ServerId, err)
+		}
+	}
+}
+
+func TestPin(t *testing.T) {
+
+	r := testRouter(t)
+	if err := r.Pin("8.8.8.8", "1", "x"); err == nil {
+		t.Errorf("Pin: accepted an address without a prefix length")
+	}
+	for _, p := range []struct{ cidr, serverId string }{
+		{"67.202.0.0/22", "toronto"},
+		{"8.8.8.8/32", "dns"},
+		{"127.0.0.0/8", "local"},
+		{"2001:4860::/32", "v6"},
+	} {
+		if err := r.Pin(p.cidr, "1", p.serverId); err != nil {
+			t.Fatalf("Pin(%s): %v", p.cidr, err)
+		}
+	}
+	var tests = []struct {
+		ip, resourceId string
+		serverId       string
+		reason         Reason
+	}{
+		{"67.202.0.0", "1", "toronto", PinnedServer},
+		{"67.202.3.255", "1", "toronto", PinnedServer},
+		{"8.8.8.8", "1", "dns", PinnedServer},
+		{"8.8.8.9", "1", "sjc", GeoHit},
+		{"127.255.255.255", "1", "local", PinnedServer},
+		{"2001:4860::8888", "1", "v6", PinnedServer},
+		{"8.8.8.8", "2", "", DefaultServer},
+	}
+	for _, tt := range tests {
+		d, _ := r.Route(tt.ip, tt.resourceId)
+		if d.ServerId != tt.serverId || d.Reason != tt.reason {
+			t.Errorf("Route(%s, %s) = %s, %v; want %s, %v", tt.ip, tt.resourceId, d.ServerId, d.Reason, tt.serverId, tt.reason)
+		}
+	}
+}
+
+func TestPinNested(t *testing.T) {
+
+	r := testRouter(t)
+	if err := r.Pin("10.0.0.0/8", "1", "big"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cidr := range []string{"10.1.0.0/16", "0.0.0.0/0", "10.0.0.0/9"} {
+		if err := r.Pin(cidr, "1", "small"); err != ErrPinOverlap {
+			t.Errorf("Pin(%s) = %v, want ErrPinOverlap", cidr, err)
+		}
+	}
+	if err := r.Pin("10.1.0.0/16", "2", "small"); err != nil {
+		t.Errorf("Pin for another resource: %v", err)
+	}
+	if err := r.Pin("10.0.0.0/8", "1", "bigger"); err != nil {
+		t.Errorf("Pin of the same CIDR: %v", err)
+	}
+	for _, ip := range []string{"10.0.0.1", "10.1.2.3", "10.2.0.1", "10.255.255.255"} {
+		if d, err := r.Route(ip, "1"); d.ServerId != "bigger" || d.Reason != PinnedServer || err != nil {
+			t.Errorf("Route(%s) = %s, %v, %v; want bigger", ip, d.ServerId, d.Reason, err)
+		}
+	}
+}
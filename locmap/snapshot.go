@@ -0,0 +1,185 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+)
+
+// snapshotMagic starts every snapshot, followed by the format version.
+// Version 1 snapshots have no Updated time; the data age of those continues
+// from Written.
+const (
+	snapshotMagic   = "LMAP"
+	snapshotVersion = 2
+)
+
+var ErrBadSnapshot = errors.New("locmap: not a snapshot or unsupported version")
+
+// A snapshot holds the registry and the grid of a LocationMap.
+type snapshot struct {
+	Written  time.Time
+	Updated  time.Time // last time a server was added, had its status set or sent a heartbeat
+	Res      float64
+	Rows     int
+	Cols     int
+	Servers  []Data
+	Expires  []time.Time // lease end of Servers[i], zero without a lease
+	Policies map[string]Policy
+	Grids    []snapGrid
+}
+
+// A snapGrid holds the closest server of a resource for every cell, row by
+// row, as an index into Servers or -1.
+type snapGrid struct {
+	ResourceId string
+	Servers    []int32
+	Dists      []float64
+}
+
+// WriteSnapshot writes the servers, policies and grid of the LocationMap to
+// w so that ReadSnapshot can restore it without recomputing the grid.
+func (m *LocationMap) WriteSnapshot(w io.Writer) error {
+	m.mutex.Lock()
+	s := &snapshot{
+		Written:  m.now(),
+		Res:      m.res,
+		Rows:     m.rows,
+		Cols:     m.cols,
+		Servers:  m.allServers(),
+		Policies: make(map[string]Policy),
+	}
+	m.rwmutex.RLock()
+	s.Updated = m.dataExp.Add(-m.maxAge)
+	for r, p := range m.policies {
+		s.Policies[r] = p
+	}
+	m.rwmutex.RUnlock()
+	index := make(map[serverKey]int32, len(s.Servers))
+	s.Expires = make([]time.Time, len(s.Servers))
+	for i, d := range s.Servers {
+		k := serverKey{d.ResourceId, d.ServerId}
+		index[k] = int32(i)
+		s.Expires[i] = m.expires[k]
+	}
+	grids := make(map[string]*snapGrid)
+	mapp := m.mapp
+	m.mutex.Unlock()
+
+	n := s.Rows * s.Cols
+	for i, row := range mapp {
+		for j, l := range row {
+			for r, id := range l.valMap {
+				g := grids[r]
+				if g == nil {
+					g = &snapGrid{
+						ResourceId: r,
+						Servers:    make([]int32, n),
+						Dists:      make([]float64, n),
+					}
+					for c := range g.Servers {
+						g.Servers[c] = -1
+					}
+					grids[r] = g
+				}
+				c := i*s.Cols + j
+				if k, ok := index[serverKey{r, id}]; ok {
+					g.Servers[c] = k
+					g.Dists[c] = l.distMap[r]
+				}
+			}
+		}
+	}
+	for _, d := range s.Servers {
+		if g := grids[d.ResourceId]; g != nil {
+			s.Grids = append(s.Grids, *g)
+			delete(grids, d.ResourceId)
+		}
+	}
+
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{snapshotVersion}); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(s)
+}
+
+// ReadSnapshot creates a LocationMap with the options and restores the
+// servers, policies and grid written by WriteSnapshot.  The grid is rebuilt
+// from the servers if the Resolution option differs from the snapshot, or
+// for resources that were given to Exact when the snapshot was written but
+// are not now.  Leases continue from the snapshot and the age of the data
+// from the last update before it.
+func ReadSnapshot(r io.Reader, opts ...Option) (*LocationMap, error) {
+	h := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, ErrBadSnapshot
+	}
+	if !bytes.Equal(h[:len(snapshotMagic)], []byte(snapshotMagic)) || h[len(snapshotMagic)] < 1 || h[len(snapshotMagic)] > snapshotVersion {
+		return nil, ErrBadSnapshot
+	}
+	s := &snapshot{}
+	if err := gob.NewDecoder(r).Decode(s); err != nil {
+		return nil, err
+	}
+
+	m := NewLocationMap(opts...)
+	if s.Rows*s.Cols == 0 || len(s.Expires) != len(s.Servers) {
+		return nil, ErrBadSnapshot
+	}
+	for i, d := range s.Servers {
+		if m.servers[d.ResourceId] == nil {
+			m.servers[d.ResourceId] = make(map[string]Data)
+		}
+		m.servers[d.ResourceId][d.ServerId] = d
+		if !s.Expires[i].IsZero() {
+			m.expires[serverKey{d.ResourceId, d.ServerId}] = s.Expires[i]
+		}
+	}
+	for r, p := range s.Policies {
+		m.policies[r] = p
+	}
+	if s.Updated.IsZero() {
+		s.Updated = s.Written
+	}
+	m.dataExp = s.Updated.Add(m.maxAge)
+
+	g := m.newGrid()
+	restored := make(map[string]bool)
+	if m.res == s.Res && m.rows == s.Rows && m.cols == s.Cols {
+		for _, sg := range s.Grids {
+			if m.exact[sg.ResourceId] {
+				continue
+			}
+			n := s.Rows * s.Cols
+			if len(sg.Servers) != n || len(sg.Dists) != n {
+				return nil, ErrBadSnapshot
+			}
+			for c, k := range sg.Servers {
+				if k < 0 {
+					continue
+				}
+				if int(k) >= len(s.Servers) || s.Servers[k].ResourceId != sg.ResourceId {
+					return nil, ErrBadSnapshot
+				}
+				g.set(c/s.Cols, c%s.Cols, sg.ResourceId, s.Servers[k].ServerId, sg.Dists[c])
+			}
+			restored[sg.ResourceId] = true
+		}
+	}
+	for _, d := range s.Servers {
+		if d.Status && !m.exact[d.ResourceId] && !restored[d.ResourceId] {
+			m.addServer(g, &d)
+		}
+	}
+	m.mapp = g.mapp
+	return m, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package locmap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func snapshotMap(opts ...Option) *LocationMap {
+	m := NewLocationMap(opts...)
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 20; i++ {
+		for _, res := range []string{"1", "2"} {
+			m.AddServer(Data{
+				Status:     i%4 != 0,
+				ResourceId: res,
+				ServerId:   strconv.Itoa(i),
+				Lat:        r.Float64()*180 - 90,
+				Lon:        r.Float64()*360 - 180,
+				Weight:     float64(i),
+				Country:    "US",
+			})
+		}
+	}
+	m.SetPolicy("2", Policy{Kind: ConsistentHash, Tolerance: 100})
+	return m
+}
+
+func sameAnswers(t *testing.T, a, b *LocationMap) {
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 500; i++ {
+		lat, lon := r.Float64()*180-90, r.Float64()*360-180
+		for _, res := range []string{"1", "2"} {
+			la, _ := a.GetServer(lat, lon, res)
+			lb, _ := b.GetServer(lat, lon, res)
+			if la != lb {
+				t.Fatalf("GetServer(%v, %v, %s) = %q after restore, want %q", lat, lon, res, lb, la)
+			}
+			la, _ = a.GetServerFor(lat, lon, res, "k")
+			lb, _ = b.GetServerFor(lat, lon, res, "k")
+			if la != lb {
+				t.Fatalf("GetServerFor(%v, %v, %s) = %q after restore, want %q", lat, lon, res, lb, la)
+			}
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	m := snapshotMap(Resolution(5))
+	var buf bytes.Buffer
+	if err := m.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), Resolution(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range []string{"1", "2"} {
+		if !reflect.DeepEqual(m.Servers(res), n.Servers(res)) {
+			t.Errorf("Servers(%s) after restore = %v, want %v", res, n.Servers(res), m.Servers(res))
+		}
+	}
+	for i := range m.mapp {
+		for j := range m.mapp[i] {
+			if !reflect.DeepEqual(m.mapp[i][j], n.mapp[i][j]) {
+				t.Fatalf("cell %d, %d after restore = %v, want %v", i, j, n.mapp[i][j], m.mapp[i][j])
+			}
+		}
+	}
+	sameAnswers(t, m, n)
+
+	// The restored map takes updates.
+	n.SetStatus("1", "0", true)
+	m.SetStatus("1", "0", true)
+	sameAnswers(t, m, n)
+
+	for _, v := range []string{"\x00", "\x03"} {
+		if _, err := ReadSnapshot(bytes.NewReader([]byte("LMAP" + v))); err != ErrBadSnapshot {
+			t.Errorf("ReadSnapshot of version %d: err = %v", v[0], err)
+		}
+	}
+	if _, err := ReadSnapshot(bytes.NewReader(buf.Bytes()[:3])); err != ErrBadSnapshot {
+		t.Errorf("ReadSnapshot of a short file: err = %v", err)
+	}
+}
+
+func TestSnapshotRebuild(t *testing.T) {
+
+	m := snapshotMap(Resolution(10), Exact("2"))
+	var buf bytes.Buffer
+	if err := m.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A different resolution and resource "2" leaving Exact rebuild the grid.
+	n, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), Resolution(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameAnswers(t, snapshotMap(Resolution(5)), n)
+}
+
+func TestSnapshotLeases(t *testing.T) {
+
+	c := &fakeClock{t: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewLocationMap(Resolution(10), Lease(time.Minute), MaxAge(time.Hour), Clock(c.Now))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a"})
+	var buf bytes.Buffer
+	if err := m.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Advance(30 * time.Second)
+	n, err := ReadSnapshot(&buf, Resolution(10), Lease(time.Minute), MaxAge(time.Hour), Clock(c.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds := n.Expire(); len(ds) != 0 {
+		t.Errorf("Expire right after restore = %v", ds)
+	}
+	c.Advance(time.Hour)
+	if _, err := n.GetServer(0, 0, "1"); err != ErrStaleData {
+		t.Errorf("GetServer of an old snapshot: err = %v", err)
+	}
+	if ds := n.Expire(); len(ds) != 1 {
+		t.Errorf("Expire after the lease ended = %v", ds)
+	}
+}
+
+func TestSnapshotDataAge(t *testing.T) {
+
+	c := &fakeClock{t: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewLocationMap(Resolution(10), MaxAge(time.Minute), Clock(c.Now))
+	m.AddServer(Data{Status: true, ResourceId: "1", ServerId: "a"})
+	c.Advance(2 * time.Minute)
+	if _, err := m.GetServer(0, 0, "1"); err != ErrStaleData {
+		t.Fatalf("GetServer before the snapshot: err = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := m.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReadSnapshot(&buf, Resolution(10), MaxAge(time.Minute), Clock(c.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := n.GetServer(0, 0, "1"); l != "a" || err != ErrStaleData {
+		t.Errorf("GetServer of a stale snapshot = %q, %v", l, err)
+	}
+
+	// A longer MaxAge on restore counts from the last update too.
+	m.WriteSnapshot(&buf)
+	if n, err = ReadSnapshot(&buf, Resolution(10), MaxAge(150*time.Second), Clock(c.Now)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.GetServer(0, 0, "1"); err != nil {
+		t.Errorf("GetServer with a longer MaxAge: err = %v", err)
+	}
+	c.Advance(time.Minute)
+	if _, err := n.GetServer(0, 0, "1"); err != ErrStaleData {
+		t.Errorf("GetServer 3m after the last update: err = %v", err)
+	}
+
+	// Version 1 snapshots only know when they were written.
+	buf.Reset()
+	buf.WriteString("LMAP\x01")
+	v1 := struct {
+		Written    time.Time
+		Res        float64
+		Rows, Cols int
+		Servers    []Data
+		Expires    []time.Time
+	}{c.Now(), 10, m.rows, m.cols, m.Servers("1"), make([]time.Time, 1)}
+	if err := gob.NewEncoder(&buf).Encode(v1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = ReadSnapshot(&buf, Resolution(10), MaxAge(time.Minute), Clock(c.Now)); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := n.GetServer(0, 0, "1"); l != "a" || err != nil {
+		t.Errorf("GetServer of a version 1 snapshot = %q, %v", l, err)
+	}
+}
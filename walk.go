@@ -0,0 +1,74 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iptrie
+
+import (
+	"net"
+	"sort"
+)
+
+// Walk calls fn for every range in the IPTrie in address order.  The
+// addresses are in their 16-byte representation.  An address added with Add
+// or AddNum is reported as a range that starts and ends with it.  Walk stops
+// when fn returns false.
+func (t *IPTrie) Walk(fn func(r Range) bool) {
+	w := &walker{fn: fn}
+	if w.walk(t, make([]byte, 0, net.IPv6len)) {
+		w.flush()
+	}
+}
+
+type walker struct {
+	fn    func(r Range) bool
+	open  *IPTrie // start of the range being walked
+	start net.IP
+}
+
+func (w *walker) walk(t *IPTrie, path []byte) bool {
+	if t.rangeStart == t {
+		if !w.flush() {
+			return false
+		}
+		w.open = t
+		w.start = toIP(path)
+	} else if t.rangeStart != nil && t.rangeStart == w.open {
+		w.open = nil
+		if !w.fn(Range{w.start, toIP(path), t.rangeStart.data}) {
+			return false
+		}
+	}
+	t.m.Lock()
+	keys := make([]int, 0, len(t.kids))
+	for key := range t.kids {
+		keys = append(keys, int(key))
+	}
+	t.m.Unlock()
+	sort.Ints(keys)
+	for _, key := range keys {
+		t.m.Lock()
+		k := t.kids[byte(key)]
+		t.m.Unlock()
+		if k != nil && !w.walk(k, append(path, byte(key))) {
+			return false
+		}
+	}
+	return true
+}
+
+// flush reports a start that was not followed by an end.
+func (w *walker) flush() bool {
+	if w.open == nil {
+		return true
+	}
+	o := w.open
+	w.open = nil
+	return w.fn(Range{w.start, w.start, o.data})
+}
+
+func toIP(path []byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, path)
+	return ip
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 The iptrie Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iptrie
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	tt := NewIPTrie()
+	tt.AddRange("192.168.42.1", "192.168.42.254", &testData{1})
+	tt.Add("10.0.0.1", &testData{2})
+	tt.AddRange("2001:db8::", "2001:db8::ffff", &testData{3})
+	tt.AddRange("192.168.40.0", "192.168.40.255", &testData{4})
+
+	var walkTests = []struct {
+		start string
+		end   string
+		i     int
+	}{
+		{"10.0.0.1", "10.0.0.1", 2},
+		{"192.168.40.0", "192.168.40.255", 4},
+		{"192.168.42.1", "192.168.42.254", 1},
+		{"2001:db8::", "2001:db8::ffff", 3},
+	}
+	var rs []Range
+	tt.Walk(func(r Range) bool {
+		rs = append(rs, r)
+		return true
+	})
+	if len(rs) != len(walkTests) {
+		t.Fatalf("Walk: %d ranges, want %d", len(rs), len(walkTests))
+	}
+	for i, w := range walkTests {
+		r := rs[i]
+		if !r.Start.Equal(net.ParseIP(w.start)) || !r.End.Equal(net.ParseIP(w.end)) || r.Data.(*testData).i != w.i {
+			t.Errorf("Walk[%d] = %v-%v %v, want %s-%s %d", i, r.Start, r.End, r.Data, w.start, w.end, w.i)
+		}
+	}
+
+	n := 0
+	tt.Walk(func(r Range) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("Walk: did not stop, %d calls", n)
+	}
+}
+
+func TestWalkBuild(t *testing.T) {
+	rs := rndRanges(500)
+	tt, err := BuildIPTrie(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	tt.Walk(func(r Range) bool {
+		if i < len(rs) && (!r.Start.Equal(rs[i].Start) || !r.End.Equal(rs[i].End)) {
+			t.Errorf("Walk[%d] = %v-%v, want %v-%v", i, r.Start, r.End, rs[i].Start, rs[i].End)
+		}
+		i++
+		return true
+	})
+	if i != len(rs) {
+		t.Errorf("Walk: %d ranges, want %d", i, len(rs))
+	}
+}